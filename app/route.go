@@ -26,7 +26,43 @@ func RegisterRoutes(r *mux.Router) {
 	r.HandleFunc("/events", services.CreateEventHandler).Methods("POST", "OPTIONS")
 	r.HandleFunc("/events/{id}", services.GetEventHandler).Methods("GET", "OPTIONS")
 	r.HandleFunc("/events/by/{activityID}", services.GetEventsByActivityID).Methods("GET", "OPTIONS")
+	r.HandleFunc("/events/at/{timestamp}", services.GetEventsAtHandler).Methods("GET", "OPTIONS")
 	r.HandleFunc("/events", services.GetEventsHandler).Methods("GET", "OPTIONS")
 	r.HandleFunc("/events/{id}", services.DeleteEventHandler).Methods("DELETE", "OPTIONS")
 	r.HandleFunc("/events/{id}", services.UpdateEventHandler).Methods("PUT", "OPTIONS")
+
+	r.HandleFunc("/timers", services.GetTimersHandler).Methods("GET", "OPTIONS")
+	r.HandleFunc("/timers/start/{activityID}", services.StartTimerHandler).Methods("POST", "OPTIONS")
+	r.HandleFunc("/timers/stop/{id}", services.StopTimerHandler).Methods("POST", "OPTIONS")
+
+	r.HandleFunc("/settings", services.GetSettingsHandler).Methods("GET", "OPTIONS")
+	r.HandleFunc("/settings", services.UpdateSettingsHandler).Methods("PUT", "OPTIONS")
+
+	r.HandleFunc("/reports/aggregate/{activityID}", services.AggregateHandler).Methods("GET", "OPTIONS")
+	r.HandleFunc("/reports/durations", services.DurationsHandler).Methods("GET", "OPTIONS")
+	r.HandleFunc("/reports/streaks/{activityID}", services.StreaksHandler).Methods("GET", "OPTIONS")
+	r.HandleFunc("/reports/heatmap/{activityID}", services.HeatmapHandler).Methods("GET", "OPTIONS")
+	r.HandleFunc("/reports/compare/{activityID}", services.CompareHandler).Methods("GET", "OPTIONS")
+	r.HandleFunc("/reports/correlation", services.CorrelationHandler).Methods("GET", "OPTIONS")
+	r.HandleFunc("/reports/anomalies/{activityID}", services.AnomaliesHandler).Methods("GET", "OPTIONS")
+
+	r.HandleFunc("/goals", services.CreateGoalHandler).Methods("POST", "OPTIONS")
+	r.HandleFunc("/goals/{id}", services.UpdateGoalHandler).Methods("PUT", "OPTIONS")
+	r.HandleFunc("/goals/{id}", services.DeleteGoalHandler).Methods("DELETE", "OPTIONS")
+	r.HandleFunc("/goals", services.GetGoalsHandler).Methods("GET", "OPTIONS")
+	r.HandleFunc("/goals/{id}", services.GetGoalHandler).Methods("GET", "OPTIONS")
+	r.HandleFunc("/goals/progress/{id}", services.GoalProgressHandler).Methods("GET", "OPTIONS")
+
+	r.HandleFunc("/search", services.SearchHandler).Methods("GET", "OPTIONS")
+	r.HandleFunc("/facets/{property}", services.FacetsHandler).Methods("GET", "OPTIONS")
+
+	r.HandleFunc("/export/csv/{activityID}", services.ExportEventsCSVHandler).Methods("GET", "OPTIONS")
+	r.HandleFunc("/import/csv/{activityID}", services.ImportCSVHandler).Methods("POST", "OPTIONS")
+	r.HandleFunc("/export/ndjson", services.ExportNDJSONHandler).Methods("GET", "OPTIONS")
+	r.HandleFunc("/import/ndjson", services.ImportNDJSONHandler).Methods("POST", "OPTIONS")
+
+	r.HandleFunc("/schema", services.GetSchemaHandler).Methods("GET", "OPTIONS")
+	r.HandleFunc("/schema/plan", services.PlanSchemaHandler).Methods("POST", "OPTIONS")
+	r.HandleFunc("/schema/apply", services.ApplySchemaHandler).Methods("POST", "OPTIONS")
+	r.HandleFunc("/schema/events/{activityID}", services.ActivityJSONSchemaHandler).Methods("GET", "OPTIONS")
 }
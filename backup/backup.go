@@ -0,0 +1,461 @@
+package backup
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/djamysh/PensieveAPI/models"
+)
+
+// A backup is a gzip compressed file of JSON lines. The first line is the header
+// with the format version, every other line is a document of a collection in the
+// canonical MongoDB Extended JSON, so the BSON types are kept on restore.
+
+const Format = "pensieve-backup"
+
+// Version of the backup format, the backups of the newer versions can not be restored
+const Version = 1
+
+const (
+	filePrefix = "pensieve-"
+	fileSuffix = ".backup.gz"
+	// UTC time in the file names, they sort by their times
+	fileTimeLayout = "20060102T150405Z"
+)
+
+// Number of the documents that are inserted at once on restore
+const restoreBatchSize = 1000
+
+type Header struct {
+	Format    string    `json:"format"`
+	Version   int       `json:"version"`
+	CreatedAt time.Time `json:"createdAt"`
+	// Consistent is false if the server does not support the snapshot reads,
+	// e.g. a standalone server, then the collections are read one by one.
+	Consistent  bool     `json:"consistent"`
+	Collections []string `json:"collections"`
+}
+
+type record struct {
+	Collection string          `json:"collection"`
+	Document   json.RawMessage `json:"document"`
+}
+
+// Config of the scheduled backups
+type Config struct {
+	Dir string
+	// Interval of the backups, no scheduled backup if zero
+	Every time.Duration
+	// Number of the backups to keep, all of them are kept if zero
+	Keep int
+}
+
+// ConfigFromEnv reads the config from PENSIEVE_BACKUP_DIR, PENSIEVE_BACKUP_EVERY (e.g. 24h) and PENSIEVE_BACKUP_KEEP
+func ConfigFromEnv() (Config, error) {
+	config := Config{Dir: "backups"}
+	if dir := os.Getenv("PENSIEVE_BACKUP_DIR"); dir != "" {
+		config.Dir = dir
+	}
+
+	var err error
+	if every := os.Getenv("PENSIEVE_BACKUP_EVERY"); every != "" {
+		if config.Every, err = time.ParseDuration(every); err != nil {
+			return config, fmt.Errorf("invalid PENSIEVE_BACKUP_EVERY: %v", err)
+		}
+	}
+	if keep := os.Getenv("PENSIEVE_BACKUP_KEEP"); keep != "" {
+		if config.Keep, err = strconv.Atoi(keep); err != nil || config.Keep < 0 {
+			return config, fmt.Errorf("invalid PENSIEVE_BACKUP_KEEP: %q", keep)
+		}
+	}
+	return config, nil
+}
+
+// snapshotContext returns the context of the reads, a session with the snapshot read
+// concern if the server supports it. ok is false if the reads are not consistent.
+func snapshotContext() (ctx context.Context, end func(), ok bool) {
+	session, err := models.Client.StartSession(options.Session().SetSnapshot(true))
+	if err != nil {
+		return context.TODO(), func() {}, false
+	}
+	ctx = mongo.NewSessionContext(context.TODO(), session)
+	end = func() { session.EndSession(context.TODO()) }
+
+	// Standalone servers reject the snapshot reads
+	if err := models.SettingsCollection.FindOne(ctx, bson.M{}).Err(); err != nil && err != mongo.ErrNoDocuments {
+		end()
+		return context.TODO(), func() {}, false
+	}
+	return ctx, end, true
+}
+
+// Write writes the backup of all of the collections
+func Write(w io.Writer) (*Header, error) {
+	ctx, end, consistent := snapshotContext()
+	defer end()
+
+	header := &Header{Format: Format, Version: Version, CreatedAt: time.Now().UTC(), Consistent: consistent}
+	for _, collection := range models.Collections() {
+		header.Collections = append(header.Collections, collection.Name())
+	}
+
+	compressor := gzip.NewWriter(w)
+	encoder := json.NewEncoder(compressor)
+	if err := encoder.Encode(header); err != nil {
+		return nil, err
+	}
+
+	for _, collection := range models.Collections() {
+		cursor, err := collection.Find(ctx, bson.M{})
+		if err != nil {
+			return nil, err
+		}
+		for cursor.Next(ctx) {
+			document, err := bson.MarshalExtJSON(cursor.Current, true, false)
+			if err != nil {
+				cursor.Close(ctx)
+				return nil, err
+			}
+			if err := encoder.Encode(record{Collection: collection.Name(), Document: document}); err != nil {
+				cursor.Close(ctx)
+				return nil, err
+			}
+		}
+		err = cursor.Err()
+		cursor.Close(ctx)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return header, compressor.Close()
+}
+
+// Create writes a backup file into the directory, the file only appears when it is complete
+func Create(dir string) (string, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+
+	path := filepath.Join(dir, filePrefix+time.Now().UTC().Format(fileTimeLayout)+fileSuffix)
+	file, err := os.CreateTemp(dir, ".backup-*")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(file.Name())
+
+	if _, err := Write(file); err != nil {
+		file.Close()
+		return "", err
+	}
+	if err := file.Close(); err != nil {
+		return "", err
+	}
+	return path, os.Rename(file.Name(), path)
+}
+
+// Prune deletes the oldest backups in the directory except the last keep ones
+func Prune(dir string, keep int) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var backups []string
+	for _, entry := range entries {
+		if !entry.IsDir() && strings.HasPrefix(entry.Name(), filePrefix) && strings.HasSuffix(entry.Name(), fileSuffix) {
+			backups = append(backups, entry.Name())
+		}
+	}
+	sort.Strings(backups)
+
+	var deleted []string
+	for len(backups) > keep {
+		path := filepath.Join(dir, backups[0])
+		if err := os.Remove(path); err != nil {
+			return deleted, err
+		}
+		deleted = append(deleted, path)
+		backups = backups[1:]
+	}
+	return deleted, nil
+}
+
+// Schedule creates a backup at every interval of the config and prunes the old ones, it does not return
+func Schedule(config Config) {
+	ticker := time.NewTicker(config.Every)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		path, err := Create(config.Dir)
+		if err != nil {
+			log.Println("ERROR while creating the scheduled backup:", err)
+			continue
+		}
+		log.Println("Backup is created:", path)
+
+		if config.Keep > 0 {
+			if _, err := Prune(config.Dir, config.Keep); err != nil {
+				log.Println("ERROR while deleting the old backups:", err)
+			}
+		}
+	}
+}
+
+// reader reads the header and the records of a backup file
+type reader struct {
+	file         *os.File
+	decompressor *gzip.Reader
+	decoder      *json.Decoder
+	header       *Header
+}
+
+func openBackup(path string) (*reader, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	decompressor, err := gzip.NewReader(bufio.NewReader(file))
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("not a backup file: %v", err)
+	}
+
+	backup := &reader{file: file, decompressor: decompressor, decoder: json.NewDecoder(decompressor)}
+	if err := backup.decoder.Decode(&backup.header); err != nil || backup.header == nil {
+		backup.Close()
+		return nil, errors.New("not a backup file: invalid header")
+	}
+	if backup.header.Format != Format {
+		backup.Close()
+		return nil, fmt.Errorf("not a backup file: unknown format %q", backup.header.Format)
+	}
+	if backup.header.Version < 1 || backup.header.Version > Version {
+		backup.Close()
+		return nil, fmt.Errorf("backup format version %d is not supported, the supported version is %d", backup.header.Version, Version)
+	}
+	return backup, nil
+}
+
+// next returns the next document, io.EOF at the end of the backup
+func (backup *reader) next() (string, bson.D, error) {
+	var current record
+	if err := backup.decoder.Decode(&current); err != nil {
+		return "", nil, err
+	}
+
+	known := false
+	for _, name := range backup.header.Collections {
+		known = known || name == current.Collection
+	}
+	if !known {
+		return "", nil, fmt.Errorf("document of the unknown collection %q", current.Collection)
+	}
+
+	var document bson.D
+	if err := bson.UnmarshalExtJSON(current.Document, true, &document); err != nil {
+		return "", nil, err
+	}
+	return current.Collection, document, nil
+}
+
+func (backup *reader) Close() {
+	backup.decompressor.Close()
+	backup.file.Close()
+}
+
+// Inspect validates the whole backup file and returns its header and the number of the documents per collection
+func Inspect(path string) (*Header, map[string]int, error) {
+	backup, err := openBackup(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer backup.Close()
+
+	counts := make(map[string]int)
+	for _, name := range backup.header.Collections {
+		counts[name] = 0
+	}
+	for {
+		collection, _, err := backup.next()
+		if err == io.EOF {
+			return backup.header, counts, nil
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("corrupted backup: %v", err)
+		}
+		counts[collection]++
+	}
+}
+
+// Suffix of the temporary collections that the backup is restored into
+const restoreSuffix = "_restore"
+
+// copyIndexes creates the indexes of the collection on the target collection, the target
+// enforces the same unique indexes before it replaces the collection.
+func copyIndexes(collection, target *mongo.Collection) error {
+	cursor, err := collection.Indexes().List(context.TODO())
+	var commandErr mongo.CommandError
+	// NamespaceNotFound, the collection is not created yet
+	if errors.As(err, &commandErr) && commandErr.Code == 26 {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	var specs []bson.D
+	if err := cursor.All(context.TODO(), &specs); err != nil {
+		return err
+	}
+
+	indexes := bson.A{}
+	for _, spec := range specs {
+		var index bson.D
+		isID := false
+		for _, field := range spec {
+			switch field.Key {
+			case "v", "ns":
+				// Set by the server
+			case "name":
+				isID = field.Value == "_id_"
+				index = append(index, field)
+			default:
+				index = append(index, field)
+			}
+		}
+		if !isID {
+			indexes = append(indexes, index)
+		}
+	}
+	if len(indexes) == 0 {
+		return nil
+	}
+	return target.Database().RunCommand(context.TODO(), bson.D{{Key: "createIndexes", Value: target.Name()}, {Key: "indexes", Value: indexes}}).Err()
+}
+
+// replaceCollection renames the temporary collection to the name of the collection, the
+// collection is dropped in the same operation
+func replaceCollection(temporary, collection *mongo.Collection) error {
+	database := collection.Database().Name()
+	command := bson.D{
+		{Key: "renameCollection", Value: database + "." + temporary.Name()},
+		{Key: "to", Value: database + "." + collection.Name()},
+		{Key: "dropTarget", Value: true},
+	}
+	return collection.Database().Client().Database("admin").RunCommand(context.TODO(), command).Err()
+}
+
+// Restore replaces the documents of the collections with the documents of the backup, the
+// collections that the backup does not have are emptied. The whole file is validated, then it
+// is restored into temporary collections with the indexes of the collections. Only a complete
+// restore replaces the collections, a failed one leaves them untouched.
+func Restore(path string) (*Header, map[string]int, error) {
+	if _, _, err := Inspect(path); err != nil {
+		return nil, nil, err
+	}
+
+	backup, err := openBackup(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer backup.Close()
+
+	collections := make(map[string]*mongo.Collection)
+	for _, collection := range models.Collections() {
+		collections[collection.Name()] = collection
+	}
+	for _, name := range backup.header.Collections {
+		if _, isExist := collections[name]; !isExist {
+			return nil, nil, fmt.Errorf("backup has the unknown collection %q", name)
+		}
+	}
+
+	// The temporary collections of a previous failed restore are dropped
+	temporaries := make(map[string]*mongo.Collection)
+	dropTemporaries := func() {
+		for _, temporary := range temporaries {
+			temporary.Drop(context.TODO())
+		}
+	}
+	for name, collection := range collections {
+		temporary := collection.Database().Collection(name + restoreSuffix)
+		temporaries[name] = temporary
+		if err := temporary.Drop(context.TODO()); err != nil {
+			return nil, nil, err
+		}
+		if err := collection.Database().CreateCollection(context.TODO(), temporary.Name()); err != nil {
+			dropTemporaries()
+			return nil, nil, err
+		}
+		if err := copyIndexes(collection, temporary); err != nil {
+			dropTemporaries()
+			return nil, nil, err
+		}
+	}
+
+	counts := make(map[string]int)
+	batches := make(map[string][]interface{})
+	flush := func(name string) error {
+		if len(batches[name]) == 0 {
+			return nil
+		}
+		if _, err := temporaries[name].InsertMany(context.TODO(), batches[name]); err != nil {
+			return err
+		}
+		counts[name] += len(batches[name])
+		batches[name] = batches[name][:0]
+		return nil
+	}
+
+	for {
+		name, document, err := backup.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			dropTemporaries()
+			return nil, nil, err
+		}
+
+		if batches[name] = append(batches[name], document); len(batches[name]) == restoreBatchSize {
+			if err := flush(name); err != nil {
+				dropTemporaries()
+				return nil, nil, err
+			}
+		}
+	}
+
+	for name := range collections {
+		if err := flush(name); err != nil {
+			dropTemporaries()
+			return nil, nil, err
+		}
+	}
+
+	// The referenced collections are replaced before the referencing ones
+	for i, collection := range models.Collections() {
+		if err := replaceCollection(temporaries[collection.Name()], collection); err != nil {
+			if i == 0 {
+				dropTemporaries()
+				return nil, nil, err
+			}
+			return nil, nil, fmt.Errorf("restore is stopped after replacing %d of the collections, restore the backup again: %v", i, err)
+		}
+	}
+	return backup.header, counts, nil
+}
@@ -0,0 +1,161 @@
+package cli
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+
+	"github.com/djamysh/PensieveAPI/models"
+	"github.com/djamysh/PensieveAPI/services"
+)
+
+// Example properties and activities of the seed command
+
+var seedProperties = []models.Property{
+	{Name: "distance", Description: "Distance in kilometers", ValueDataType: "number"},
+	{Name: "mood", Description: "Mood from 1 to 10", ValueDataType: "number"},
+	{Name: "pages", Description: "Number of the read pages", ValueDataType: "number"},
+	{Name: "book", Description: "Title of the book", ValueDataType: "string"},
+	{Name: "tags", Description: "Free tags", ValueDataType: "string array"},
+}
+
+var seedActivities = []struct {
+	activity   models.Activity
+	properties []string
+}{
+	{models.Activity{Name: "Running", Description: "Outdoor and treadmill runs"}, []string{"distance", "mood", "tags"}},
+	{models.Activity{Name: "Reading", Description: "Reading sessions"}, []string{"book", "pages", "tags"}},
+	{models.Activity{Name: "Meditation", Description: "Meditation sessions"}, []string{"mood"}},
+}
+
+var adminCommands = map[string]command{
+	"init":  {"Create the collections and the indexes", adminInit},
+	"reset": {"Delete all of the data", adminReset},
+	"seed":  {"Create the example properties and activities", adminSeed},
+	"stats": {"Print the statistics of the collections", adminStats},
+}
+
+func adminUsage() {
+	fmt.Fprintln(os.Stderr, "Usage: pensieve admin [command] [flags]\n\nCommands:")
+
+	names := make([]string, 0, len(adminCommands))
+	for name := range adminCommands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %-12s %s\n", name, adminCommands[name].description)
+	}
+}
+
+func admin(args []string) error {
+	if len(args) == 0 {
+		adminUsage()
+		return errors.New("admin command is not given")
+	}
+
+	command, isExist := adminCommands[args[0]]
+	if !isExist {
+		adminUsage()
+		return fmt.Errorf("unknown admin command %q", args[0])
+	}
+	return command.run(args[1:])
+}
+
+func adminInit(args []string) error {
+	created, err := models.CreateCollections()
+	if err != nil {
+		return err
+	}
+	for _, name := range created {
+		fmt.Println("Collection is created:", name)
+	}
+
+	// The bootstrap of the server, it creates the indexes and the built-in properties
+	if err := services.Bootstrap(); err != nil {
+		return err
+	}
+	fmt.Println("Database is initialized.")
+	return nil
+}
+
+func adminReset(args []string) error {
+	flags := flag.NewFlagSet("admin reset", flag.ExitOnError)
+	yes := flags.Bool("yes", false, "Do not ask for the confirmation")
+	flags.Parse(args)
+
+	if !*yes && !confirm(fmt.Sprintf("All of the data in %s will be deleted.", models.DBName)) {
+		return errors.New("reset is cancelled")
+	}
+
+	if err := models.ResetCollections(); err != nil {
+		return err
+	}
+	// The built-in properties are deleted with the others
+	if err := services.Bootstrap(); err != nil {
+		return err
+	}
+	fmt.Println("Database is reset.")
+	return nil
+}
+
+func adminSeed(args []string) error {
+	if err := services.Bootstrap(); err != nil {
+		return err
+	}
+
+	propertyIDs := make(map[string]primitive.ObjectID)
+	for _, property := range seedProperties {
+		existing, err := models.GetPropertyByName(property.Name)
+		if err == nil {
+			propertyIDs[property.Name] = existing.ID
+			continue
+		} else if err != mongo.ErrNoDocuments {
+			return err
+		}
+
+		property.ID = primitive.NewObjectID()
+		if err := property.CreateProperty(); err != nil {
+			return err
+		}
+		propertyIDs[property.Name] = property.ID
+		fmt.Println("Property is created:", property.Name)
+	}
+
+	for _, seed := range seedActivities {
+		activity := seed.activity
+		if _, err := models.GetActivityByName(activity.Name); err == nil {
+			continue
+		} else if err != mongo.ErrNoDocuments {
+			return err
+		}
+
+		// Every activity has the built-in properties
+		activity.DefinedProperties = models.BuiltInPropertyIDs()
+		for _, name := range seed.properties {
+			activity.DefinedProperties = append(activity.DefinedProperties, propertyIDs[name])
+		}
+		if err := activity.CreateActivity(); err != nil {
+			return err
+		}
+		fmt.Println("Activity is created:", activity.Name)
+	}
+	return nil
+}
+
+func adminStats(args []string) error {
+	fmt.Printf("%-12s %10s %12s %12s %8s %12s\n", "collection", "documents", "size", "storage", "indexes", "index size")
+	for _, collection := range models.Collections() {
+		stats, err := models.GetCollectionStats(collection)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%-12s %10d %12d %12d %8d %12d\n", stats.Name, stats.Count, stats.Size, stats.StorageSize, stats.Indexes, stats.TotalIndexSize)
+	}
+	return nil
+}
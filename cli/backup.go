@@ -0,0 +1,88 @@
+package cli
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+
+	"github.com/djamysh/PensieveAPI/backup"
+	"github.com/djamysh/PensieveAPI/models"
+	"github.com/djamysh/PensieveAPI/services"
+)
+
+func backupCommand(args []string) error {
+	// The flags default to the config of the scheduled backups of the server
+	config, err := backup.ConfigFromEnv()
+	if err != nil {
+		return err
+	}
+
+	flags := flag.NewFlagSet("backup", flag.ExitOnError)
+	flags.StringVar(&config.Dir, "dir", config.Dir, "Directory of the backups")
+	flags.IntVar(&config.Keep, "keep", config.Keep, "Number of the backups to keep, 0 keeps all of them")
+	flags.DurationVar(&config.Every, "every", config.Every, "Keep running and create a backup at every interval, e.g. 24h")
+	flags.Parse(args)
+
+	path, err := backup.Create(config.Dir)
+	if err != nil {
+		return err
+	}
+	fmt.Println("Backup is created:", path)
+
+	if config.Keep > 0 {
+		deleted, err := backup.Prune(config.Dir, config.Keep)
+		if err != nil {
+			return err
+		}
+		for _, path := range deleted {
+			fmt.Println("Old backup is deleted:", path)
+		}
+	}
+
+	if config.Every > 0 {
+		backup.Schedule(config)
+	}
+	return nil
+}
+
+func restoreCommand(args []string) error {
+	flags := flag.NewFlagSet("restore", flag.ExitOnError)
+	path := flags.String("file", "", "Path of the backup file")
+	yes := flags.Bool("yes", false, "Do not ask for the confirmation")
+	flags.Parse(args)
+
+	if *path == "" {
+		flags.Usage()
+		return errors.New("-file is required")
+	}
+
+	// Validate the backup before asking
+	header, counts, err := backup.Inspect(*path)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Backup of %s, format version %d\n", header.CreatedAt.Format("2006-01-02 15:04:05 MST"), header.Version)
+	for _, name := range header.Collections {
+		fmt.Printf("  %-12s %d documents\n", name, counts[name])
+	}
+	// The collections of the newer versions are emptied
+	for _, collection := range models.Collections() {
+		if _, isExist := counts[collection.Name()]; !isExist {
+			fmt.Printf("  %-12s not in the backup, emptied\n", collection.Name())
+		}
+	}
+
+	if !*yes && !confirm("All of the current data will be replaced.") {
+		return errors.New("restore is cancelled")
+	}
+
+	if _, counts, err = backup.Restore(*path); err != nil {
+		return err
+	}
+	for _, collection := range models.Collections() {
+		fmt.Printf("Restored %d documents of %s\n", counts[collection.Name()], collection.Name())
+	}
+
+	// The backups of the older versions may not have the built-in properties
+	return services.Bootstrap()
+}
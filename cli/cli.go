@@ -0,0 +1,61 @@
+package cli
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Commands of the pensieve binary, the server is started when no command is given.
+// e.g. pensieve import-csv -activity 64a... -file history.csv -dry-run
+
+type command struct {
+	description string
+	run         func(args []string) error
+}
+
+var commands = map[string]command{
+	"import-csv": {"Import the events of an activity from a CSV file", importCSV},
+	"backup":     {"Create a backup of all of the collections", backupCommand},
+	"restore":    {"Replace all of the data with a backup", restoreCommand},
+	"admin":      {"Initialize, reset, seed or inspect the database", admin},
+	"schema":     {"Export, plan or apply the schema of the properties and activities", schemaCommand},
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "Usage: pensieve [command] [flags]")
+	fmt.Fprintln(os.Stderr, "\nWithout a command the API server is started.\n\nCommands:")
+
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %-12s %s\n", name, commands[name].description)
+	}
+}
+
+// confirm asks the user to type yes for the destructive commands
+func confirm(message string) bool {
+	fmt.Printf("%s Type yes to continue: ", message)
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	return strings.TrimSpace(answer) == "yes"
+}
+
+// Run runs the command of the given arguments, the arguments exclude the program name
+func Run(args []string) error {
+	if len(args) == 0 || args[0] == "help" || args[0] == "-h" || args[0] == "--help" {
+		usage()
+		return nil
+	}
+
+	command, isExist := commands[args[0]]
+	if !isExist {
+		usage()
+		return fmt.Errorf("unknown command %q", args[0])
+	}
+	return command.run(args[1:])
+}
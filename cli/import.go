@@ -0,0 +1,65 @@
+package cli
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"os"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/djamysh/PensieveAPI/services"
+)
+
+func importCSV(args []string) error {
+	flags := flag.NewFlagSet("import-csv", flag.ExitOnError)
+	activity := flags.String("activity", "", "ID of the activity of the events")
+	path := flags.String("file", "", "Path of the CSV file")
+	mappingPath := flags.String("mapping", "", "Path of the JSON column mapping, the headers of the CSV export are used if not given")
+	tz := flags.String("tz", "", "Timezone of the dates in the file, defaults to the configured timezone")
+	dryRun := flags.Bool("dry-run", false, "Validate the rows without inserting them")
+	flags.Parse(args)
+
+	if *activity == "" || *path == "" {
+		flags.Usage()
+		return errors.New("-activity and -file are required")
+	}
+	activityID, err := primitive.ObjectIDFromHex(*activity)
+	if err != nil {
+		return err
+	}
+
+	var mapping services.CSVImportMapping
+	if *mappingPath != "" {
+		content, err := os.ReadFile(*mappingPath)
+		if err != nil {
+			return err
+		}
+		if err := json.Unmarshal(content, &mapping); err != nil {
+			return err
+		}
+	}
+
+	loc, err := services.Location(*tz)
+	if err != nil {
+		return err
+	}
+
+	if err := services.Bootstrap(); err != nil {
+		return err
+	}
+
+	file, err := os.Open(*path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	report, err := services.ImportCSV(activityID, file, mapping, loc, *dryRun)
+	if report != nil {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(report)
+	}
+	return err
+}
@@ -0,0 +1,109 @@
+package cli
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/djamysh/PensieveAPI/services"
+)
+
+var changeSymbols = map[string]string{
+	services.ChangeCreate: "+",
+	services.ChangeUpdate: "~",
+	services.ChangeDelete: "-",
+}
+
+func printChanges(changes []services.SchemaChange) {
+	if len(changes) == 0 {
+		fmt.Println("Database matches the schema.")
+		return
+	}
+
+	for _, change := range changes {
+		fmt.Printf("%s %s %s\n", changeSymbols[change.Action], change.Kind, change.Name)
+
+		fields := make([]string, 0, len(change.Fields))
+		for field := range change.Fields {
+			fields = append(fields, field)
+		}
+		sort.Strings(fields)
+		for _, field := range fields {
+			fmt.Printf("    %s: %v -> %v\n", field, change.Fields[field].From, change.Fields[field].To)
+		}
+		for _, cascade := range change.Cascades {
+			fmt.Printf("    ! %s\n", cascade)
+		}
+	}
+}
+
+func schemaCommand(args []string) error {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, "Usage: pensieve schema [export|plan|apply] [flags]")
+		return errors.New("schema command is not given")
+	}
+
+	flags := flag.NewFlagSet("schema "+args[0], flag.ExitOnError)
+	path := flags.String("file", "", "Path of the YAML or JSON schema")
+	prune := flags.Bool("prune", false, "Delete the properties and activities that are not in the schema")
+	yes := flags.Bool("yes", false, "Apply without asking for the confirmation")
+	flags.Parse(args[1:])
+
+	// The built-in properties are left out of the schema
+	if err := services.Bootstrap(); err != nil {
+		return err
+	}
+
+	if args[0] == "export" {
+		schema, err := services.CurrentSchema()
+		if err != nil {
+			return err
+		}
+		return yaml.NewEncoder(os.Stdout).Encode(schema)
+	}
+	if args[0] != "plan" && args[0] != "apply" {
+		return fmt.Errorf("unknown schema command %q", args[0])
+	}
+
+	if *path == "" {
+		flags.Usage()
+		return errors.New("-file is required")
+	}
+	data, err := os.ReadFile(*path)
+	if err != nil {
+		return err
+	}
+	schema, err := services.ParseSchema(data)
+	if err != nil {
+		return err
+	}
+
+	changes, err := services.PlanSchema(schema, *prune)
+	if err != nil {
+		return err
+	}
+	printChanges(changes)
+	if args[0] == "plan" || len(changes) == 0 {
+		return nil
+	}
+
+	if !*yes && services.IsDestructive(changes) && !confirm("The changes above affect the existing data.") {
+		return errors.New("apply is cancelled")
+	}
+
+	// The confirmed plan is applied, it is aborted if the database changed in the meantime
+	applied, err := services.ApplySchema(schema, *prune, changes)
+	if err != nil && len(applied) != 0 {
+		fmt.Println("Applied changes before the error:")
+		printChanges(applied)
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%d changes are applied.\n", len(applied))
+	return nil
+}
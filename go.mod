@@ -5,6 +5,7 @@ go 1.18
 require (
 	github.com/gorilla/mux v1.8.0
 	go.mongodb.org/mongo-driver v1.11.1
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
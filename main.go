@@ -3,8 +3,14 @@ package main
 import (
 	"log"
 	"net/http"
+	"os"
+	// Embedded timezone database for the timezone aware date bucketing
+	_ "time/tzdata"
 
 	"github.com/djamysh/PensieveAPI/app"
+	"github.com/djamysh/PensieveAPI/backup"
+	"github.com/djamysh/PensieveAPI/cli"
+	"github.com/djamysh/PensieveAPI/services"
 	"github.com/gorilla/mux"
 )
 
@@ -42,17 +48,29 @@ import (
 
 func main() {
 
-	/*
-		var err error
-		// Check if default timelings properties are created
-		// models.DefaultTimelingsPropertyID, err = models.DefaultTimelingsProperty()
-
-		if err != nil {
-			log.Fatal("ERROR while trying to obtain Default Timelings Property ID ")
+	// Run the command instead of the server if one is given, the commands
+	// bootstrap the database themselves so the recovery commands can run
+	// even if the bootstrap fails.
+	if len(os.Args) > 1 {
+		if err := cli.Run(os.Args[1:]); err != nil {
 			log.Fatal(err)
-
 		}
-	*/
+		return
+	}
+
+	// Create the indexes and check if default timelings and note properties are created
+	if err := services.Bootstrap(); err != nil {
+		log.Fatal("ERROR while trying to bootstrap the database: ", err)
+	}
+
+	// Scheduled backups are configured by the environment variables
+	backupConfig, err := backup.ConfigFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if backupConfig.Every > 0 {
+		go backup.Schedule(backupConfig)
+	}
 
 	// Define the router
 	r := mux.NewRouter()
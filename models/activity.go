@@ -2,39 +2,84 @@ package models
 
 import (
 	"context"
+	"time"
 
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
+// Overlap policies of an activity, they decide what happens when an
+// event's interval overlaps with another event of the same activity.
+const (
+	OverlapAllow  = "allow"
+	OverlapWarn   = "warn"
+	OverlapReject = "reject"
+)
+
 type Activity struct {
 	ID                primitive.ObjectID   `bson:"_id,omitempty" json:"id"`
 	Name              string               `bson:"name" json:"name" validate:"unique"`
 	Description       string               `bson:"description" json:"description"`
 	DefinedProperties []primitive.ObjectID `bson:"definedProperties" json:"definedProperties"`
+	OverlapPolicy     string               `bson:"overlapPolicy,omitempty" json:"overlapPolicy,omitempty"`
+	// Pointer to distinguish the not given value in the update requests
+	AllowConcurrentTimers *bool     `bson:"allowConcurrentTimers,omitempty" json:"allowConcurrentTimers,omitempty"`
+	CreatedAt             time.Time `bson:"createdAt" json:"createdAt"`
+	UpdatedAt             time.Time `bson:"updatedAt" json:"updatedAt"`
+}
+
+func (activity *Activity) IsValidOverlapPolicy() bool {
+	switch activity.OverlapPolicy {
+	case "", OverlapAllow, OverlapWarn, OverlapReject:
+		return true
+	}
+	return false
+}
+
+// AllowsConcurrentTimers reports whether the activity can have more than one running timer
+func (activity *Activity) AllowsConcurrentTimers() bool {
+	return activity.AllowConcurrentTimers != nil && *activity.AllowConcurrentTimers
 }
 
 func (activity *Activity) CreateActivity() error {
 
 	// Insert the activity into the MongoDB collection
 	activity.ID = primitive.NewObjectID()
+	// Timestamps are managed by the server, client given values are overwritten
+	activity.CreatedAt = time.Now().UTC()
+	activity.UpdatedAt = activity.CreatedAt
 
 	_, err := ActivitiesCollection.InsertOne(context.TODO(), activity)
 	return err
 
 }
 
+// ImportActivity inserts the activity of another instance keeping its ID and timestamps
+func (activity *Activity) ImportActivity() error {
+	if activity.CreatedAt.IsZero() {
+		activity.CreatedAt = time.Now().UTC()
+	}
+	if activity.UpdatedAt.IsZero() {
+		activity.UpdatedAt = activity.CreatedAt
+	}
+
+	_, err := ActivitiesCollection.InsertOne(context.TODO(), activity)
+	return err
+}
+
 func (activity *Activity) UpdateActivity(id primitive.ObjectID) error {
 	// looks like it is going to be obsolote
 
 	// Update the activity in the MongoDB collection
 	activity.ID = id
+	activity.UpdatedAt = time.Now().UTC()
 	_, err := ActivitiesCollection.ReplaceOne(context.TODO(), bson.M{"_id": id}, activity)
 
 	return err
 }
 func UpdateActivity(id primitive.ObjectID, update bson.M) (*Activity, error) {
 	var activity Activity
+	update["updatedAt"] = time.Now().UTC()
 	if err := ActivitiesCollection.FindOneAndUpdate(context.TODO(), bson.M{"_id": id}, bson.M{"$set": update}).Decode(&activity); err != nil {
 		return nil, err
 	}
@@ -2,12 +2,15 @@ package models
 
 import (
 	"context"
+	"errors"
 	"log"
 	"time"
 
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/djamysh/PensieveAPI/utils"
 )
 
 var Client *mongo.Client
@@ -18,6 +21,15 @@ var EventsCollectionName = "events"
 var EventsCollection *mongo.Collection
 var PropertiesCollectionName = "properties"
 var PropertiesCollection *mongo.Collection
+var GoalsCollectionName = "goals"
+var GoalsCollection *mongo.Collection
+var SettingsCollectionName = "settings"
+var SettingsCollection *mongo.Collection
+
+// Collections returns the collections of the API, the referenced collections come before the referencing ones
+func Collections() []*mongo.Collection {
+	return []*mongo.Collection{PropertiesCollection, ActivitiesCollection, EventsCollection, GoalsCollection, SettingsCollection}
+}
 
 func Connect2DB() {
 	// Connect to MongoDB
@@ -35,7 +47,7 @@ func Connect2DB() {
 
 }
 
-func CreateUniqueFieldInCollection(collection *mongo.Collection, field string, order int) {
+func CreateUniqueFieldInCollection(collection *mongo.Collection, field string, order int) error {
 	// order-> -1:desending 1:ascending order
 
 	// Create a unique index on the given field of the collection
@@ -46,9 +58,194 @@ func CreateUniqueFieldInCollection(collection *mongo.Collection, field string, o
 			Options: options.Index().SetUnique(true),
 		},
 	)
+	return err
+}
+
+func CreateIndexInCollection(collection *mongo.Collection, field string, order int) error {
+	// order-> -1:desending 1:ascending order
+
+	// Create a non-unique index on the given field of the collection
+	_, err := collection.Indexes().CreateOne(
+		context.TODO(),
+		mongo.IndexModel{
+			Keys: bson.M{field: order},
+		},
+	)
+	return err
+}
+
+// CreatePartialUniqueFieldInCollection creates a unique index on the given field of the
+// documents that have the field, the documents without it do not conflict.
+func CreatePartialUniqueFieldInCollection(collection *mongo.Collection, field string, order int) error {
+	_, err := collection.Indexes().CreateOne(
+		context.TODO(),
+		mongo.IndexModel{
+			Keys: bson.M{field: order},
+			Options: options.Index().SetUnique(true).
+				SetPartialFilterExpression(bson.M{field: bson.M{"$exists": true}}),
+		},
+	)
+	return err
+}
+
+func CreateTextIndexInCollection(collection *mongo.Collection, fields ...string) error {
+	// A collection can only have one text index, therefore all of the fields are in the same index
+	keys := bson.D{}
+	for _, field := range fields {
+		keys = append(keys, bson.E{Key: field, Value: "text"})
+	}
+
+	_, err := collection.Indexes().CreateOne(
+		context.TODO(),
+		mongo.IndexModel{
+			Keys: keys,
+		},
+	)
+	return err
+}
+
+// EnsureIndexes creates the indexes of the collections if they are not created yet
+func EnsureIndexes() error {
+	indexes := []func() error{
+		// Create a unique index on the 'name' field of the PropertiesCollection collection
+		func() error { return CreateUniqueFieldInCollection(PropertiesCollection, "name", 1) },
+		// Create a unique index on the 'name' field of the ActivitiesCollection collection
+		func() error { return CreateUniqueFieldInCollection(ActivitiesCollection, "name", 1) },
+		// Create an index on the 'occurredAt' field of the EventsCollection for the time based queries
+		func() error { return CreateIndexInCollection(EventsCollection, "occurredAt", 1) },
+		// Create a unique index on the 'runningTimer' field of the EventsCollection, an activity
+		// that does not allow the concurrent timers can not have a second running timer
+		func() error { return CreatePartialUniqueFieldInCollection(EventsCollection, "runningTimer", 1) },
+
+		// Create the text indexes of the full-text search, string and string array
+		// property values of the events are indexed through propertyValues.value
+		func() error { return CreateTextIndexInCollection(EventsCollection, "propertyValues.value") },
+		func() error { return CreateTextIndexInCollection(ActivitiesCollection, "name", "description") },
+		func() error { return CreateTextIndexInCollection(PropertiesCollection, "name", "description") },
+	}
+	for _, createIndex := range indexes {
+		if err := createIndex(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// BackfillTimestamps sets the createdAt and updatedAt of the documents that are created before
+// the fields existed, and the occurredAt of such events, to the creation time in their IDs.
+// It only updates the documents that do not have the fields, so it runs once in effect.
+func BackfillTimestamps() error {
+	idTime := bson.M{"$toDate": "$_id"}
+	fields := map[*mongo.Collection][]string{
+		PropertiesCollection: {"createdAt", "updatedAt"},
+		ActivitiesCollection: {"createdAt", "updatedAt"},
+		EventsCollection:     {"createdAt", "updatedAt", "occurredAt"},
+	}
+	for collection, names := range fields {
+		for _, name := range names {
+			_, err := collection.UpdateMany(
+				context.TODO(),
+				bson.M{name: bson.M{"$exists": false}},
+				// Pipeline update to read the _id of every document
+				mongo.Pipeline{{{Key: "$set", Value: bson.M{name: idTime}}}},
+			)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// IsUnsupportedErr reports whether the server rejected a query because it does not support
+// one of its operators or stages, e.g. the operators that are added in later MongoDB versions
+// or that the MongoDB compatible backends do not implement.
+func IsUnsupportedErr(err error) bool {
+	var commandErr mongo.CommandError
+	if !errors.As(err, &commandErr) {
+		return false
+	}
+	switch commandErr.Code {
+	// InvalidPipelineOperator, unknown group operator, unrecognized pipeline stage, CommandNotSupported
+	case 168, 15952, 40324, 115:
+		return true
+	}
+	return false
+}
+
+// CreateCollections creates the collections that do not exist yet and returns their names
+func CreateCollections() ([]string, error) {
+	database := Client.Database(DBName)
+	existing, err := database.ListCollectionNames(context.TODO(), bson.M{})
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
+	isExist := make(map[string]bool)
+	for _, name := range existing {
+		isExist[name] = true
+	}
+
+	var created []string
+	for _, collection := range Collections() {
+		if isExist[collection.Name()] {
+			continue
+		}
+		if err := database.CreateCollection(context.TODO(), collection.Name()); err != nil {
+			return created, err
+		}
+		created = append(created, collection.Name())
+	}
+	return created, nil
+}
+
+// CollectionStats are the storage statistics of a collection, the sizes are in bytes
+type CollectionStats struct {
+	Name           string `bson:"name" json:"name"`
+	Count          int64  `bson:"count" json:"count"`
+	Size           int64  `bson:"size" json:"size"`
+	StorageSize    int64  `bson:"storageSize" json:"storageSize"`
+	Indexes        int64  `bson:"nindexes" json:"indexes"`
+	TotalIndexSize int64  `bson:"totalIndexSize" json:"totalIndexSize"`
+}
+
+// GetCollectionStats returns the storage statistics of the collection
+func GetCollectionStats(collection *mongo.Collection) (*CollectionStats, error) {
+	pipeline := []bson.M{
+		{"$collStats": bson.M{"storageStats": bson.M{}}},
+		{"$replaceRoot": bson.M{"newRoot": "$storageStats"}},
+	}
+	cursor, err := collection.Aggregate(context.TODO(), pipeline)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(context.TODO())
+
+	// The numbers may be stored as int32, int64 or double
+	var results []bson.M
+	if err := cursor.All(context.TODO(), &results); err != nil {
+		return nil, err
+	}
+
+	stats := &CollectionStats{Name: collection.Name()}
+	if len(results) == 0 {
+		return stats, nil
+	}
+	stats.Count, _ = utils.ToInt64(results[0]["count"])
+	stats.Size, _ = utils.ToInt64(results[0]["size"])
+	stats.StorageSize, _ = utils.ToInt64(results[0]["storageSize"])
+	stats.Indexes, _ = utils.ToInt64(results[0]["nindexes"])
+	stats.TotalIndexSize, _ = utils.ToInt64(results[0]["totalIndexSize"])
+	return stats, nil
+}
+
+// ResetCollections deletes all of the documents of the collections, the collections and their indexes are kept
+func ResetCollections() error {
+	for _, collection := range Collections() {
+		if _, err := collection.DeleteMany(context.TODO(), bson.M{}); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func init() {
@@ -56,10 +253,8 @@ func init() {
 	ActivitiesCollection = Client.Database(DBName).Collection(ActivitiesCollectionName)
 	EventsCollection = Client.Database(DBName).Collection(EventsCollectionName)
 	PropertiesCollection = Client.Database(DBName).Collection(PropertiesCollectionName)
-
-	// Create a unique index on the 'name' field of the PropertiesCollection collection
-	CreateUniqueFieldInCollection(PropertiesCollection, "name", 1)
-	// Create a unique index on the 'name' field of the ActivitiesCollection collection
-	CreateUniqueFieldInCollection(ActivitiesCollection, "name", 1)
-
+	GoalsCollection = Client.Database(DBName).Collection(GoalsCollectionName)
+	SettingsCollection = Client.Database(DBName).Collection(SettingsCollectionName)
+	// The indexes are created by the bootstrap of the server and the commands, the
+	// connection is lazy so the commands that do not use the database can run without it.
 }
@@ -2,9 +2,17 @@ package models
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
 
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/djamysh/PensieveAPI/utils"
 )
 
 // Model for test purposes
@@ -12,26 +20,218 @@ type Event struct {
 	ID             primitive.ObjectID `bson:"_id,omitempty" json:"id"`
 	ActivityID     primitive.ObjectID `bson:"activityID" json:"activityID"`
 	PropertyValues []PropertyValue    `bson:"propertyValues" json:"propertyValues"`
+	// OccurredAt is the moment that the event happened, it defaults to the
+	// submission time. CreatedAt and UpdatedAt are managed by the server.
+	OccurredAt time.Time `bson:"occurredAt" json:"occurredAt"`
+	CreatedAt  time.Time `bson:"createdAt" json:"createdAt"`
+	UpdatedAt  time.Time `bson:"updatedAt" json:"updatedAt"`
+	// RunningTimer is the activity ID of a running timer of an activity that does not allow
+	// the concurrent timers, its unique index allows one running timer per such activity.
+	RunningTimer *primitive.ObjectID `bson:"runningTimer,omitempty" json:"-"`
+}
+
+// RunningTimerErr is the error of a second running timer of an activity that does not allow it
+var RunningTimerErr = errors.New("Activity already has a running timer.")
+
+// RunningTimersFilter matches the events that have a started but not ended default timelings
+func RunningTimersFilter() bson.M {
+	return bson.M{
+		"propertyValues": bson.M{
+			"$elemMatch": bson.M{
+				"key":         DefaultTimelingsPropertyID,
+				"value.start": bson.M{"$exists": true},
+				"value.end":   bson.M{"$exists": false},
+			},
+		},
+	}
+}
+
+// IsRunningTimer reports whether the default timelings of the values has a start but not an end
+func IsRunningTimer(propertyValues []PropertyValue) bool {
+	for _, pair := range propertyValues {
+		if pair.Key != DefaultTimelingsPropertyID {
+			continue
+		}
+		timelings, ok := utils.ToTimelings(pair.Value)
+		if !ok {
+			return false
+		}
+		_, isStarted := timelings["start"]
+		_, isEnded := timelings["end"]
+		return isStarted && !isEnded
+	}
+	return false
+}
+
+// runningTimerKey returns the runningTimer of the event values, nil if it is not a running
+// timer or its activity allows the concurrent timers. The activities are cached in the map.
+func runningTimerKey(activityID primitive.ObjectID, propertyValues []PropertyValue, activities map[primitive.ObjectID]*Activity) (*primitive.ObjectID, error) {
+	if !IsRunningTimer(propertyValues) {
+		return nil, nil
+	}
+	activity, isExist := activities[activityID]
+	if !isExist {
+		var err error
+		if activity, err = GetActivity(activityID); err != nil {
+			return nil, err
+		}
+		activities[activityID] = activity
+	}
+	if activity.AllowsConcurrentTimers() {
+		return nil, nil
+	}
+	return &activityID, nil
 }
 
-func CreateEvent(activityID primitive.ObjectID, propertyValues []PropertyValue) (*Event, error) {
+// runningTimerErr converts the violation of the running timer index to RunningTimerErr
+func runningTimerErr(err error) error {
+	if mongo.IsDuplicateKeyError(err) && strings.Contains(err.Error(), "runningTimer") {
+		return RunningTimerErr
+	}
+	return err
+}
+
+// SetRunningTimers sets the runningTimer of the running timers of the activity if it does
+// not allow the concurrent timers, otherwise it removes them. RunningTimerErr is returned
+// if the activity has more than one running timer, then none of them is set.
+func SetRunningTimers(activityID primitive.ObjectID, allowConcurrentTimers bool) error {
+	filter := RunningTimersFilter()
+	filter["activityID"] = activityID
+	unset := bson.M{"$unset": bson.M{"runningTimer": ""}}
+	if allowConcurrentTimers {
+		_, err := EventsCollection.UpdateMany(context.TODO(), filter, unset)
+		return err
+	}
+
+	_, err := EventsCollection.UpdateMany(context.TODO(), filter, bson.M{"$set": bson.M{"runningTimer": activityID}})
+	if err = runningTimerErr(err); err == RunningTimerErr {
+		EventsCollection.UpdateMany(context.TODO(), filter, unset)
+	}
+	return err
+}
+
+// OccurredTime returns the occurredAt of the event, the events that are created
+// before the occurredAt field existed fall back to their creation time.
+func (event *Event) OccurredTime() time.Time {
+	if event.OccurredAt.IsZero() {
+		return event.ID.Timestamp().UTC()
+	}
+	return event.OccurredAt
+}
+
+func CreateEvent(activityID primitive.ObjectID, occurredAt time.Time, propertyValues []PropertyValue) (*Event, error) {
+
+	now := time.Now().UTC()
+	if occurredAt.IsZero() {
+		occurredAt = now
+	}
+
+	runningTimer, err := runningTimerKey(activityID, propertyValues, make(map[primitive.ObjectID]*Activity))
+	if err != nil {
+		return nil, err
+	}
 
 	event := &Event{
 		ID:             primitive.NewObjectID(),
 		ActivityID:     activityID,
 		PropertyValues: propertyValues,
+		OccurredAt:     occurredAt.UTC(),
+		CreatedAt:      now,
+		UpdatedAt:      now,
+		RunningTimer:   runningTimer,
 	}
 
 	// Insert the event into the MongoDB collection
 	insertResult, err := EventsCollection.InsertOne(context.TODO(), event)
 	if err != nil {
-		return nil, err
+		return nil, runningTimerErr(err)
 	}
 
 	event.ID = insertResult.InsertedID.(primitive.ObjectID)
 	return event, nil
 }
 
+// InsertEvents inserts the given events at once, their IDs and timestamps are set
+func InsertEvents(events []*Event) error {
+	if len(events) == 0 {
+		return nil
+	}
+
+	now := time.Now().UTC()
+	activities := make(map[primitive.ObjectID]*Activity)
+	documents := make([]interface{}, 0, len(events))
+	for _, event := range events {
+		var err error
+		if event.RunningTimer, err = runningTimerKey(event.ActivityID, event.PropertyValues, activities); err != nil {
+			return err
+		}
+		event.ID = primitive.NewObjectID()
+		if event.OccurredAt.IsZero() {
+			event.OccurredAt = now
+		}
+		event.OccurredAt = event.OccurredAt.UTC()
+		event.CreatedAt = now
+		event.UpdatedAt = now
+		documents = append(documents, event)
+	}
+
+	_, err := EventsCollection.InsertMany(context.TODO(), documents)
+	return runningTimerErr(err)
+}
+
+// InsertErrors are the errors of the events that an unordered insert rejected, keyed by
+// the indexes of the events. The other events are inserted.
+type InsertErrors map[int]error
+
+func (errs InsertErrors) Error() string {
+	return fmt.Sprintf("%d events are not inserted", len(errs))
+}
+
+// insertErrors converts the write errors of an unordered insert into InsertErrors, the
+// other errors e.g. a write concern error are returned as they are.
+func insertErrors(err error) error {
+	var bulkErr mongo.BulkWriteException
+	if !errors.As(err, &bulkErr) || bulkErr.WriteConcernError != nil || len(bulkErr.WriteErrors) == 0 {
+		return runningTimerErr(err)
+	}
+	errs := make(InsertErrors)
+	for _, writeErr := range bulkErr.WriteErrors {
+		errs[writeErr.Index] = runningTimerErr(writeErr)
+	}
+	return errs
+}
+
+// ImportEvents inserts the events of another instance at once keeping their IDs and timestamps.
+// The insert is unordered, the events that are rejected e.g. a second running timer of an
+// activity are returned as InsertErrors and the others are inserted.
+func ImportEvents(events []*Event) error {
+	if len(events) == 0 {
+		return nil
+	}
+
+	activities := make(map[primitive.ObjectID]*Activity)
+	documents := make([]interface{}, 0, len(events))
+	for _, event := range events {
+		var err error
+		if event.RunningTimer, err = runningTimerKey(event.ActivityID, event.PropertyValues, activities); err != nil {
+			return err
+		}
+		if event.OccurredAt.IsZero() {
+			event.OccurredAt = event.ID.Timestamp().UTC()
+		}
+		if event.CreatedAt.IsZero() {
+			event.CreatedAt = event.ID.Timestamp().UTC()
+		}
+		if event.UpdatedAt.IsZero() {
+			event.UpdatedAt = event.CreatedAt
+		}
+		documents = append(documents, event)
+	}
+
+	_, err := EventsCollection.InsertMany(context.TODO(), documents, options.InsertMany().SetOrdered(false))
+	return insertErrors(err)
+}
+
 func GetEvent(id primitive.ObjectID) (*Event, error) {
 	// Get the event from the MongoDB collection
 	var event Event
@@ -82,11 +282,46 @@ func GetEventsByFilter(filter bson.M) ([]Event, error) {
 	return events, nil
 }
 
-// UpdateEvent updates a specific event in the database
+// GetRecentEvents returns the last events that match the filter by their occurredAt, the latest first
+func GetRecentEvents(filter bson.M, limit int64) ([]Event, error) {
+	var events []Event
+	opts := options.Find().SetSort(bson.D{{Key: "occurredAt", Value: -1}, {Key: "_id", Value: -1}}).SetLimit(limit)
+	cursor, err := EventsCollection.Find(context.TODO(), filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(context.TODO())
+
+	if err := cursor.All(context.TODO(), &events); err != nil {
+		return nil, err
+	}
+	return events, nil
+}
+
+// UpdateEvent updates a specific event in the database. The runningTimer is set from
+// the property values if the update has both the activityID and the propertyValues, the
+// other updates of the values e.g. the relations do not change the default timelings.
 func UpdateEvent(id primitive.ObjectID, update bson.M) (*Event, error) {
 	var event Event
-	if err := EventsCollection.FindOneAndUpdate(context.TODO(), bson.M{"_id": id}, bson.M{"$set": update}).Decode(&event); err != nil {
-		return nil, err
+	update["updatedAt"] = time.Now().UTC()
+	document := bson.M{"$set": update}
+
+	propertyValues, hasValues := update["propertyValues"].([]PropertyValue)
+	activityID, hasActivity := update["activityID"].(primitive.ObjectID)
+	if hasValues && hasActivity {
+		runningTimer, err := runningTimerKey(activityID, propertyValues, make(map[primitive.ObjectID]*Activity))
+		if err != nil {
+			return nil, err
+		}
+		if runningTimer != nil {
+			update["runningTimer"] = *runningTimer
+		} else {
+			document["$unset"] = bson.M{"runningTimer": ""}
+		}
+	}
+
+	if err := EventsCollection.FindOneAndUpdate(context.TODO(), bson.M{"_id": id}, document).Decode(&event); err != nil {
+		return nil, runningTimerErr(err)
 	}
 	return &event, nil
 }
@@ -98,3 +333,47 @@ func DeleteEvent(id primitive.ObjectID) error {
 	}
 	return nil
 }
+
+// AggregateEvents runs the given aggregation pipeline on the events and decodes the results
+func AggregateEvents(pipeline []bson.M, results interface{}) error {
+	cursor, err := EventsCollection.Aggregate(context.TODO(), pipeline)
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(context.TODO())
+
+	return cursor.All(context.TODO(), results)
+}
+
+// StreamEvents decodes the events that match the filter one by one in the order of their
+// occurredAt and passes them to fn, without loading all of them into memory.
+func StreamEvents(filter bson.M, fn func(event *Event) error) error {
+	opts := options.Find().SetSort(bson.D{{Key: "occurredAt", Value: 1}, {Key: "_id", Value: 1}})
+	cursor, err := EventsCollection.Find(context.TODO(), filter, opts)
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(context.TODO())
+
+	for cursor.Next(context.TODO()) {
+		var event Event
+		if err := cursor.Decode(&event); err != nil {
+			return err
+		}
+		if err := fn(&event); err != nil {
+			return err
+		}
+	}
+	return cursor.Err()
+}
+
+// CountEvents returns the number of the events that match the filter
+func CountEvents(filter bson.M) (int64, error) {
+	return EventsCollection.CountDocuments(context.TODO(), filter)
+}
+
+// DeleteEventsByFilter deletes the events that match the filter
+func DeleteEventsByFilter(filter bson.M) error {
+	_, err := EventsCollection.DeleteMany(context.TODO(), filter)
+	return err
+}
@@ -0,0 +1,101 @@
+package models
+
+import (
+	"context"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Metrics of a goal, the value of a period is the number of events, the sum
+// of the number property or the tracked time of the interval events in seconds.
+const (
+	GoalMetricCount    = "count"
+	GoalMetricSum      = "sum"
+	GoalMetricDuration = "duration"
+)
+
+// Limit modes of the upper bound goals, soft limits warn at the event
+// creation while hard limits block the creation of the event.
+const (
+	GoalModeSoft = "soft"
+	GoalModeHard = "hard"
+)
+
+// Goal is a target for an activity per period, e.g. at most 5 cigarettes per day
+// -> {period: day, metric: count, comparator: lte, target: 5}
+type Goal struct {
+	ID         primitive.ObjectID  `bson:"_id,omitempty" json:"id"`
+	Name       string              `bson:"name" json:"name"`
+	ActivityID primitive.ObjectID  `bson:"activityID" json:"activityID"`
+	PropertyID *primitive.ObjectID `bson:"propertyID,omitempty" json:"propertyID,omitempty"`
+	Period     string              `bson:"period" json:"period"`
+	Metric     string              `bson:"metric" json:"metric"`
+	Comparator string              `bson:"comparator" json:"comparator"`
+	Target     float64             `bson:"target" json:"target"`
+	Mode       string              `bson:"mode,omitempty" json:"mode,omitempty"`
+	CreatedAt  time.Time           `bson:"createdAt" json:"createdAt"`
+	UpdatedAt  time.Time           `bson:"updatedAt" json:"updatedAt"`
+}
+
+// IsLimit reports whether the goal is an upper bound, e.g. at most 5 cigarettes per day
+func (goal *Goal) IsLimit() bool {
+	return goal.Comparator == "lt" || goal.Comparator == "lte"
+}
+
+func (goal *Goal) CreateGoal() error {
+	goal.ID = primitive.NewObjectID()
+	// Timestamps are managed by the server, client given values are overwritten
+	goal.CreatedAt = time.Now().UTC()
+	goal.UpdatedAt = goal.CreatedAt
+
+	_, err := GoalsCollection.InsertOne(context.TODO(), goal)
+	return err
+}
+
+func UpdateGoal(id primitive.ObjectID, update bson.M) (*Goal, error) {
+	var goal Goal
+	update["updatedAt"] = time.Now().UTC()
+
+	if err := GoalsCollection.FindOneAndUpdate(context.TODO(), bson.M{"_id": id}, bson.M{"$set": update}).Decode(&goal); err != nil {
+		return nil, err
+	}
+	return &goal, nil
+}
+
+func DeleteGoal(id primitive.ObjectID) error {
+	// Delete the goal from the MongoDB collection
+	_, err := GoalsCollection.DeleteOne(context.TODO(), bson.M{"_id": id})
+	return err
+}
+
+// DeleteGoalsByFilter deletes the goals that match the filter, e.g. goals of a deleted activity
+func DeleteGoalsByFilter(filter bson.M) error {
+	_, err := GoalsCollection.DeleteMany(context.TODO(), filter)
+	return err
+}
+
+func GetGoal(id primitive.ObjectID) (*Goal, error) {
+	// Get the goal from the MongoDB collection
+	var goal Goal
+	err := GoalsCollection.FindOne(context.TODO(), bson.M{"_id": id}).Decode(&goal)
+	return &goal, err
+}
+
+func GetGoalsByFilter(filter bson.M) ([]Goal, error) {
+	// Define a slice of goals to store the results
+	var goals []Goal
+
+	// Find the goals that match the filter
+	cursor, err := GoalsCollection.Find(context.TODO(), filter)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(context.TODO())
+
+	if err = cursor.All(context.TODO(), &goals); err != nil {
+		return nil, err
+	}
+	return goals, nil
+}
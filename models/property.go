@@ -2,18 +2,38 @@ package models
 
 import (
 	"context"
+	"fmt"
+	"log"
+	"time"
 
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+
+	"github.com/djamysh/PensieveAPI/utils"
 )
 
 var ValidDataTypes = [5]string{"string", "number", "timelings", "string array", "number array"}
 
+// Built-in properties, every activity has them as defined properties.
+// Their IDs are set on startup by the bootstrap.
+const DefaultTimelingsPropertyName = "timelings"
+const DefaultNotePropertyName = "note"
+
+var DefaultTimelingsPropertyID primitive.ObjectID
+var DefaultNotePropertyID primitive.ObjectID
+
 type Property struct {
 	ID            primitive.ObjectID `bson:"_id,omitempty" json:"id"`
 	Name          string             `bson:"name" json:"name" validate:"unique"`
 	Description   string             `bson:"description" json:"description"`
 	ValueDataType string             `bson:"valueDataType" json:"valueDataType"`
+	// Formula of a computed property, e.g. "distance / duration(timelings)"
+	Formula string `bson:"formula,omitempty" json:"formula,omitempty"`
+	// System properties are the built-in properties managed by the server
+	System    bool      `bson:"system" json:"system"`
+	CreatedAt time.Time `bson:"createdAt" json:"createdAt"`
+	UpdatedAt time.Time `bson:"updatedAt" json:"updatedAt"`
 }
 
 func (P *Property) IsValidType() bool {
@@ -32,13 +52,30 @@ func (P *Property) IsValidType() bool {
 }
 
 func (property *Property) CreateProperty() error {
+	// Timestamps are managed by the server, client given values are overwritten
+	property.CreatedAt = time.Now().UTC()
+	property.UpdatedAt = property.CreatedAt
 
 	_, err := PropertiesCollection.InsertOne(context.TODO(), property)
 
 	return err
 }
 
+// ImportProperty inserts the property of another instance keeping its ID and timestamps
+func (property *Property) ImportProperty() error {
+	if property.CreatedAt.IsZero() {
+		property.CreatedAt = time.Now().UTC()
+	}
+	if property.UpdatedAt.IsZero() {
+		property.UpdatedAt = property.CreatedAt
+	}
+
+	_, err := PropertiesCollection.InsertOne(context.TODO(), property)
+	return err
+}
+
 func (property *Property) UpdateProperty(id primitive.ObjectID) error {
+	property.UpdatedAt = time.Now().UTC()
 
 	_, err := PropertiesCollection.ReplaceOne(context.TODO(), bson.M{"_id": id}, property)
 	return err
@@ -47,6 +84,7 @@ func (property *Property) UpdateProperty(id primitive.ObjectID) error {
 
 func UpdateProperty(id primitive.ObjectID, update bson.M) (*Property, error) {
 	var property Property
+	update["updatedAt"] = time.Now().UTC()
 
 	if err := PropertiesCollection.FindOneAndUpdate(context.TODO(), bson.M{"_id": id}, bson.M{"$set": update}).Decode(&property); err != nil {
 		return nil, err
@@ -87,3 +125,107 @@ func GetProperties() ([]*Property, error) {
 	}
 	return properties, nil
 }
+
+func GetPropertiesByFilter(filter bson.M) ([]Property, error) {
+	// Define a slice of properties to store the results
+	var properties []Property
+
+	// Find the properties that match the filter
+	cursor, err := PropertiesCollection.Find(context.TODO(), filter)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(context.TODO())
+
+	if err = cursor.All(context.TODO(), &properties); err != nil {
+		return nil, err
+	}
+	return properties, nil
+}
+
+// migrateUserProperty renames the user defined property that has the name of a built-in
+// property to a free name, the formulas that reference it follow the new name. The values
+// of the events are kept, they are keyed by the property ID.
+func migrateUserProperty(property *Property) error {
+	name := property.Name + " (user)"
+	for i := 2; ; i++ {
+		if _, err := GetPropertyByName(name); err == mongo.ErrNoDocuments {
+			break
+		} else if err != nil {
+			return err
+		}
+		name = fmt.Sprintf("%s (user %d)", property.Name, i)
+	}
+
+	if _, err := UpdateProperty(property.ID, bson.M{"name": name}); err != nil {
+		return err
+	}
+
+	computedProperties, err := GetPropertiesByFilter(bson.M{"formula": bson.M{"$exists": true, "$ne": ""}})
+	if err != nil {
+		return err
+	}
+	for _, computed := range computedProperties {
+		formula, err := utils.ParseFormula(computed.Formula)
+		if err != nil {
+			continue
+		}
+		for _, ref := range formula.References() {
+			if ref.Name == property.Name {
+				if _, err := UpdateProperty(computed.ID, bson.M{"formula": formula.RenameReference(property.Name, name).String()}); err != nil {
+					return err
+				}
+				break
+			}
+		}
+	}
+
+	log.Printf("Migration: property %q is renamed to %q, the name is reserved for the built-in property.", property.Name, name)
+	return nil
+}
+
+// systemProperty finds the built-in property with the given name or creates it. A user
+// defined property with the same name is renamed instead of being used as the built-in one.
+func systemProperty(name, description, valueDataType string) (primitive.ObjectID, error) {
+	property, err := GetPropertyByName(name)
+	if err == nil && property.System {
+		if property.ValueDataType != valueDataType {
+			return primitive.NilObjectID, fmt.Errorf("built-in property %q has the data type %q, it requires %q", name, property.ValueDataType, valueDataType)
+		}
+		return property.ID, nil
+	}
+	if err == nil {
+		if err := migrateUserProperty(property); err != nil {
+			return primitive.NilObjectID, err
+		}
+		err = mongo.ErrNoDocuments
+	}
+	if err != mongo.ErrNoDocuments {
+		return primitive.NilObjectID, err
+	}
+
+	property = &Property{
+		ID:            primitive.NewObjectID(),
+		Name:          name,
+		Description:   description,
+		ValueDataType: valueDataType,
+		System:        true,
+	}
+	if err := property.CreateProperty(); err != nil {
+		return primitive.NilObjectID, err
+	}
+	return property.ID, nil
+}
+
+func DefaultTimelingsProperty() (primitive.ObjectID, error) {
+	return systemProperty(DefaultTimelingsPropertyName, "Built-in timelings of the event, 'instant' or 'start' and 'end' timestamps.", "timelings")
+}
+
+func DefaultNoteProperty() (primitive.ObjectID, error) {
+	return systemProperty(DefaultNotePropertyName, "Built-in free text note of the event.", "string")
+}
+
+// BuiltInPropertyIDs returns the IDs of the properties that every activity must define
+func BuiltInPropertyIDs() []primitive.ObjectID {
+	return []primitive.ObjectID{DefaultTimelingsPropertyID, DefaultNotePropertyID}
+}
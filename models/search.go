@@ -0,0 +1,75 @@
+package models
+
+import (
+	"context"
+	"errors"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Search results with the text score of the MongoDB text index
+
+type EventSearchResult struct {
+	Event `bson:",inline"`
+	Score float64 `bson:"score"`
+}
+
+type ActivitySearchResult struct {
+	Activity `bson:",inline"`
+	Score    float64 `bson:"score"`
+}
+
+type PropertySearchResult struct {
+	Property `bson:",inline"`
+	Score    float64 `bson:"score"`
+}
+
+// IsTextSearchUnsupportedErr reports whether the text search is rejected because the collection
+// does not have a text index or the backend does not support the text search
+func IsTextSearchUnsupportedErr(err error) bool {
+	var commandErr mongo.CommandError
+	// IndexNotFound
+	if errors.As(err, &commandErr) && commandErr.Code == 27 {
+		return true
+	}
+	return IsUnsupportedErr(err)
+}
+
+// searchCollection finds the documents that match the text search filter ordered by their text score
+func searchCollection(collection *mongo.Collection, filter bson.M, limit int64, results interface{}) error {
+	score := bson.M{"score": bson.M{"$meta": "textScore"}}
+	opts := options.Find().SetProjection(score).SetSort(score).SetLimit(limit)
+
+	cursor, err := collection.Find(context.TODO(), filter, opts)
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(context.TODO())
+
+	return cursor.All(context.TODO(), results)
+}
+
+// TextSearchFilter returns the filter of the given text search, it can be extended with the other conditions
+func TextSearchFilter(search string) bson.M {
+	return bson.M{"$text": bson.M{"$search": search}}
+}
+
+func SearchEvents(filter bson.M, limit int64) ([]EventSearchResult, error) {
+	var results []EventSearchResult
+	err := searchCollection(EventsCollection, filter, limit, &results)
+	return results, err
+}
+
+func SearchActivities(filter bson.M, limit int64) ([]ActivitySearchResult, error) {
+	var results []ActivitySearchResult
+	err := searchCollection(ActivitiesCollection, filter, limit, &results)
+	return results, err
+}
+
+func SearchProperties(filter bson.M, limit int64) ([]PropertySearchResult, error) {
+	var results []PropertySearchResult
+	err := searchCollection(PropertiesCollection, filter, limit, &results)
+	return results, err
+}
@@ -0,0 +1,70 @@
+package models
+
+import (
+	"context"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// The settings collection has a document with the global settings and a document
+// for each workspace that overrides them
+const settingsID = "global"
+
+// Prefix of the IDs of the workspace settings documents
+const workspaceSettingsPrefix = "workspace/"
+
+const DefaultTimezone = "UTC"
+
+type Settings struct {
+	ID string `bson:"_id" json:"-"`
+	// IANA time zone name, e.g. Europe/Istanbul, used by the date bucketing and range filters
+	Timezone string `bson:"timezone" json:"timezone"`
+}
+
+func settingsDocumentID(workspace string) string {
+	if workspace == "" {
+		return settingsID
+	}
+	return workspaceSettingsPrefix + workspace
+}
+
+func getSettingsDocument(id string) (*Settings, error) {
+	settings := Settings{ID: id}
+	err := SettingsCollection.FindOne(context.TODO(), bson.M{"_id": id}).Decode(&settings)
+	if err != nil && err != mongo.ErrNoDocuments {
+		return nil, err
+	}
+	return &settings, nil
+}
+
+// GetSettings returns the settings of the workspace, the global settings if the workspace is
+// empty. The fields that the workspace does not set are inherited from the global settings,
+// and the default settings are used if nothing is stored yet.
+func GetSettings(workspace string) (*Settings, error) {
+	settings, err := getSettingsDocument(settingsDocumentID(workspace))
+	if err != nil {
+		return nil, err
+	}
+	if settings.Timezone == "" && workspace != "" {
+		global, err := getSettingsDocument(settingsID)
+		if err != nil {
+			return nil, err
+		}
+		settings.Timezone = global.Timezone
+	}
+	if settings.Timezone == "" {
+		settings.Timezone = DefaultTimezone
+	}
+	return settings, nil
+}
+
+// UpdateSettings updates the settings of the workspace, the global settings if the workspace is empty
+func UpdateSettings(workspace string, update bson.M) (*Settings, error) {
+	_, err := SettingsCollection.UpdateOne(context.TODO(), bson.M{"_id": settingsDocumentID(workspace)}, bson.M{"$set": update}, options.Update().SetUpsert(true))
+	if err != nil {
+		return nil, err
+	}
+	return GetSettings(workspace)
+}
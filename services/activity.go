@@ -2,13 +2,16 @@ package services
 
 import (
 	"encoding/json"
+	"fmt"
 	"net/http"
 
 	"github.com/gorilla/mux"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
 
 	"github.com/djamysh/PensieveAPI/models"
+	"github.com/djamysh/PensieveAPI/utils"
 )
 
 // route handler functions for the models.Activity model
@@ -22,6 +25,15 @@ func CreateActivityHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	defer r.Body.Close()
 
+	activity.OverlapPolicy = utils.CleanInput(activity.OverlapPolicy)
+	if !activity.IsValidOverlapPolicy() {
+		http.Error(w, "Invalid overlap policy.", http.StatusBadRequest)
+		return
+	}
+
+	// Every activity has the built-in properties
+	activity.DefinedProperties = ensureBuiltInProperties(activity.DefinedProperties)
+
 	err = activity.CreateActivity()
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -71,9 +83,15 @@ func UpdateActivityEventRelations(activityID primitive.ObjectID, newDefinedPrope
 	if err != nil {
 		return err
 	}
+	return updateEventRelations(activityID, previousActivity.DefinedProperties, newDefinedProperties)
+}
+
+// updateEventRelations adds the default values of the added properties to the events of
+// the activity and removes the values of the removed ones.
+func updateEventRelations(activityID primitive.ObjectID, previousDefinedProperties, newDefinedProperties []primitive.ObjectID) error {
 
 	// Finds the changed properties
-	changedProperties := diffDefinedProperties(previousActivity.DefinedProperties, newDefinedProperties)
+	changedProperties := diffDefinedProperties(previousDefinedProperties, newDefinedProperties)
 
 	// Gets the events that are related to updated activity
 	relatedEvents, err := models.GetEventsByFilter(bson.M{"activityID": activityID})
@@ -94,7 +112,7 @@ func UpdateActivityEventRelations(activityID primitive.ObjectID, newDefinedPrope
 					return err
 				}
 				// Setting the null/default value
-				propertyValues[propertyID] = TypeNullMap[property.ValueDataType]
+				propertyValues[propertyID] = defaultPropertyValue(property, relatedEvent.OccurredTime())
 
 			} else {
 				// removed property
@@ -105,6 +123,10 @@ func UpdateActivityEventRelations(activityID primitive.ObjectID, newDefinedPrope
 		}
 		// Converting back to DB submitable format
 		propertyValuesSlice := PropertyValueConvertion(propertyValues)
+		// Computed properties may be added or their inputs may be removed
+		if err := recomputeValues(propertyValuesSlice); err != nil {
+			return err
+		}
 		// Updating the new propertyValues
 		_, err := models.UpdateEvent(relatedEvent.ID, bson.M{"propertyValues": propertyValuesSlice})
 		if err != nil {
@@ -137,6 +159,28 @@ func UpdateActivityHandler(w http.ResponseWriter, r *http.Request) {
 	// Overwrite in case of id value change attempt
 	activity.ID = id
 
+	// The update is validated before the events are touched
+	if _, err := models.GetActivity(id); err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if activity.Name != "" {
+		namesake, err := models.GetActivityByName(activity.Name)
+		if err == nil && namesake.ID != id {
+			http.Error(w, "Activity name is already in use.", http.StatusConflict)
+			return
+		} else if err != nil && err != mongo.ErrNoDocuments {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	for _, propertyID := range activity.DefinedProperties {
+		if _, err := models.GetProperty(propertyID); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid property ID %s.", propertyID.Hex()), http.StatusBadRequest)
+			return
+		}
+	}
+
 	//TODO: What happens if the user defines the same property twice
 	update := make(map[string]interface{})
 
@@ -148,22 +192,51 @@ func UpdateActivityHandler(w http.ResponseWriter, r *http.Request) {
 	if activity.Description != "" {
 		update["description"] = activity.Description
 	}
+	if activity.OverlapPolicy != "" {
+		activity.OverlapPolicy = utils.CleanInput(activity.OverlapPolicy)
+		if !activity.IsValidOverlapPolicy() {
+			http.Error(w, "Invalid overlap policy.", http.StatusBadRequest)
+			return
+		}
+		update["overlapPolicy"] = activity.OverlapPolicy
+	}
+	if activity.AllowConcurrentTimers != nil {
+		update["allowConcurrentTimers"] = *activity.AllowConcurrentTimers
+	}
 	if activity.DefinedProperties != nil {
+		// Built-in properties can not be removed from the activity
+		activity.DefinedProperties = ensureBuiltInProperties(activity.DefinedProperties)
 		update["definedProperties"] = activity.DefinedProperties
 		updateRelationsFlag = true
 	}
 	update_bsonM := bson.M(update)
 
+	// The running timers follow the allowConcurrentTimers before it is stored
+	if activity.AllowConcurrentTimers != nil {
+		if err := setRunningTimers(id, *activity.AllowConcurrentTimers); err != nil {
+			if _, isEventErr := err.(*utils.EventError); isEventErr {
+				http.Error(w, err.Error(), http.StatusConflict)
+			} else {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+			}
+			return
+		}
+	}
+
 	//err = activity.UpdateActivity(id)
 	oldValue, err := models.UpdateActivity(id, update_bsonM)
 
-	if err != nil {
+	if mongo.IsDuplicateKeyError(err) {
+		http.Error(w, "Activity name is already in use.", http.StatusConflict)
+		return
+	} else if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
+	// The events follow the defined properties of the previous value
 	if updateRelationsFlag {
-		if err := UpdateActivityEventRelations(id, activity.DefinedProperties); err != nil {
+		if err := updateEventRelations(id, oldValue.DefinedProperties, activity.DefinedProperties); err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
@@ -173,6 +246,22 @@ func UpdateActivityHandler(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(oldValue)
 }
 
+// deleteActivity deletes the activity with its events and goals
+func deleteActivity(id primitive.ObjectID) error {
+	// Delete the activity from the MongoDB collection
+	if err := models.DeleteActivity(id); err != nil {
+		return err
+	}
+
+	// Deletes the all related events
+	if err := models.DeleteEventsByFilter(bson.M{"activityID": id}); err != nil {
+		return err
+	}
+
+	// Deletes the goals of the deleted activity
+	return models.DeleteGoalsByFilter(bson.M{"activityID": id})
+}
+
 func DeleteActivityHandler(w http.ResponseWriter, r *http.Request) {
 	// TODO: condsider adding/handling options, because currently
 	// as default delete handler deletes the activity and all related events.
@@ -186,29 +275,22 @@ func DeleteActivityHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Delete the activity from the MongoDB collection
-	err = models.DeleteActivity(id)
-	if err != nil {
+	if err := deleteActivity(id); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	// Gets the events that are related to deleted activity
-	relatedEvents, err := models.GetEventsByFilter(bson.M{"activityID": id})
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-	}
-
-	// Deletes the all related events
-	for _, relatedEvent := range relatedEvents {
-		models.DeleteEvent(relatedEvent.ID)
-	}
-
 	// Send a response indicating that the activity was deleted successfully
 	w.WriteHeader(http.StatusNoContent)
 }
 
 func GetActivityHandler(w http.ResponseWriter, r *http.Request) {
+	expander, err := newExpander(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
 	// Get the activity ID from the URL
 	vars := mux.Vars(r)
 
@@ -225,36 +307,66 @@ func GetActivityHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Inline the requested property definitions
+	response, err := expander.Activity(activity)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
 	// Send the activity as a response
-	json.NewEncoder(w).Encode(activity)
+	json.NewEncoder(w).Encode(response)
 }
 
 func GetActivityByNameHandler(w http.ResponseWriter, r *http.Request) {
+	expander, err := newExpander(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
 	// Get the activity ID from the URL
 	vars := mux.Vars(r)
 
 	name := vars["name"]
 
 	var activity *models.Activity
-	activity, err := models.GetActivityByName(name)
+	activity, err = models.GetActivityByName(name)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusNotFound)
 		return
 	}
 
+	// Inline the requested property definitions
+	response, err := expander.Activity(activity)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
 	// Send the activity as a response
-	json.NewEncoder(w).Encode(activity)
+	json.NewEncoder(w).Encode(response)
 }
 
 func GetActivitiesHandler(w http.ResponseWriter, r *http.Request) {
+	expander, err := newExpander(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
 	var activities []*models.Activity
-	var err error
 	if activities, err = models.GetActivities(); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
+	responses, err := expander.Activities(activities)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
 	// Send the activities as a response
-	json.NewEncoder(w).Encode(activities)
+	json.NewEncoder(w).Encode(responses)
 }
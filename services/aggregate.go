@@ -0,0 +1,294 @@
+package services
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+
+	"github.com/djamysh/PensieveAPI/models"
+	"github.com/djamysh/PensieveAPI/utils"
+)
+
+var defaultPercentiles = []float64{50, 90}
+
+type AggregateBucket struct {
+	Start time.Time `json:"start"`
+	Count int64     `json:"count"`
+	// Value statistics are only given when a property is requested
+	Sum         *float64           `json:"sum,omitempty"`
+	Avg         *float64           `json:"avg,omitempty"`
+	Min         *float64           `json:"min,omitempty"`
+	Max         *float64           `json:"max,omitempty"`
+	Percentiles map[string]float64 `json:"percentiles,omitempty"`
+}
+
+type AggregateResponse struct {
+	ActivityID string             `json:"activityID"`
+	PropertyID string             `json:"propertyID,omitempty"`
+	Bucket     string             `json:"bucket"`
+	Timezone   string             `json:"timezone"`
+	Buckets    []*AggregateBucket `json:"buckets"`
+}
+
+// aggregatePick is a value of a bucket at an index in the sorted values, from 0
+type aggregatePick struct {
+	Index int64   `bson:"index"`
+	Value float64 `bson:"value"`
+}
+
+// aggregateResult is the decoded result of the aggregation pipeline
+type aggregateResult struct {
+	Start time.Time `bson:"_id"`
+	Count int64     `bson:"count"`
+	// Number of the events that have a number value
+	ValueCount int64   `bson:"valueCount"`
+	Sum        float64 `bson:"sum"`
+	Avg        float64 `bson:"avg"`
+	Min        float64 `bson:"min"`
+	Max        float64 `bson:"max"`
+	// Only the values that the percentiles are interpolated from
+	Picks []aggregatePick `bson:"picks"`
+}
+
+// percentile interpolates the percentile of the bucket from its picked values like the
+// percentile of the sorted values
+func (result *aggregateResult) percentile(p float64) float64 {
+	values := make(map[int64]float64, len(result.Picks))
+	for _, pick := range result.Picks {
+		values[pick.Index] = pick.Value
+	}
+	rank := p / 100 * float64(result.ValueCount-1)
+	lower, upper := values[int64(math.Floor(rank))], values[int64(math.Ceil(rank))]
+	return lower + (rank-math.Floor(rank))*(upper-lower)
+}
+
+// bucket converts the result into the response bucket
+func (result *aggregateResult) bucket(property *models.Property, percentiles []float64, loc *time.Location) *AggregateBucket {
+	aggregateBucket := &AggregateBucket{Start: result.Start.In(loc), Count: result.Count}
+	if property == nil || result.ValueCount == 0 {
+		return aggregateBucket
+	}
+	aggregateBucket.Sum = &result.Sum
+	aggregateBucket.Avg = &result.Avg
+	aggregateBucket.Min = &result.Min
+	aggregateBucket.Max = &result.Max
+
+	aggregateBucket.Percentiles = make(map[string]float64)
+	for _, p := range percentiles {
+		aggregateBucket.Percentiles[strconv.FormatFloat(p, 'f', -1, 64)] = result.percentile(p)
+	}
+	return aggregateBucket
+}
+
+func parsePercentiles(value string) ([]float64, error) {
+	if value == "" {
+		return defaultPercentiles, nil
+	}
+
+	var percentiles []float64
+	for _, field := range strings.Split(value, ",") {
+		p, err := strconv.ParseFloat(strings.TrimSpace(field), 64)
+		if err != nil || p < 0 || p > 100 {
+			return nil, fmt.Errorf("Invalid percentile : %s", field)
+		}
+		percentiles = append(percentiles, p)
+	}
+	return percentiles, nil
+}
+
+// AggregateHandler groups the events of an activity by time bucket and computes
+// the count and, if a number property is given, the statistics of its values.
+// e.g. /reports/aggregate/{activityID}?property=mood&bucket=day&from=2023-01-01&percentiles=50,90
+func AggregateHandler(w http.ResponseWriter, r *http.Request) {
+	params, err := parseReportParams(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	query := r.URL.Query()
+	bucket := utils.CleanInput(query.Get("bucket"))
+	if bucket == "" {
+		bucket = utils.BucketDay
+	}
+	if !utils.IsValidBucket(bucket) {
+		http.Error(w, "Invalid bucket.", http.StatusBadRequest)
+		return
+	}
+
+	percentiles, err := parsePercentiles(query.Get("percentiles"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var property *models.Property
+	if value := query.Get("property"); value != "" {
+		if property, err = resolveNumberProperty(value); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	buckets, err := aggregateEvents(params, property, bucket, percentiles)
+	if models.IsUnsupportedErr(err) {
+		buckets, err = aggregateEventsInMemory(params, property, bucket, percentiles)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	response := AggregateResponse{
+		ActivityID: params.ActivityID.Hex(),
+		Bucket:     bucket,
+		Timezone:   params.Location.String(),
+		Buckets:    buckets,
+	}
+	if property != nil {
+		response.PropertyID = property.ID.Hex()
+	}
+
+	json.NewEncoder(w).Encode(response)
+}
+
+// aggregateEvents runs the bucketing aggregation pipeline, $dateTrunc and $setWindowFields
+// require MongoDB 5.0 or later. The values of a bucket are not collected, they are sorted
+// in the bucket and only the values at the indexes of the percentiles are kept.
+func aggregateEvents(params *reportParams, property *models.Property, bucket string, percentiles []float64) ([]*AggregateBucket, error) {
+	bucketStart := bson.M{
+		"$dateTrunc": bson.M{
+			"date":        "$occurredAt",
+			"unit":        bucket,
+			"timezone":    params.Location.String(),
+			"startOfWeek": "monday",
+		},
+	}
+	pipeline := []bson.M{params.matchStage()}
+
+	if property == nil {
+		pipeline = append(pipeline,
+			bson.M{"$group": bson.M{"_id": bucketStart, "count": bson.M{"$sum": 1}}},
+			bson.M{"$sort": bson.M{"_id": 1}},
+		)
+	} else {
+		// Indexes of the values that the percentiles are interpolated from
+		lastIndex := bson.M{"$subtract": bson.A{"$valueCount", 1}}
+		isPicked := bson.A{}
+		for _, p := range percentiles {
+			rank := bson.M{"$multiply": bson.A{p / 100, lastIndex}}
+			isPicked = append(isPicked, bson.M{"$in": bson.A{"$index", bson.A{bson.M{"$floor": rank}, bson.M{"$ceil": rank}}}})
+		}
+		wholeBucket := bson.M{"documents": bson.A{"unbounded", "unbounded"}}
+		value := propertyValueExpression(property.ID)
+
+		pipeline = append(pipeline,
+			// The values that are not numbers are nulls, they are counted as events but not as values
+			bson.M{"$project": bson.M{
+				"bucket": bucketStart,
+				"value":  bson.M{"$cond": bson.A{bson.M{"$isNumber": value}, value, nil}},
+			}},
+			bson.M{"$setWindowFields": bson.M{
+				"partitionBy": "$bucket",
+				"sortBy":      bson.M{"value": 1},
+				"output": bson.M{
+					"position":   bson.M{"$documentNumber": bson.M{}},
+					"count":      bson.M{"$count": bson.M{}, "window": wholeBucket},
+					"valueCount": bson.M{"$sum": bson.M{"$cond": bson.A{bson.M{"$eq": bson.A{"$value", nil}}, 0, 1}}, "window": wholeBucket},
+					"sum":        bson.M{"$sum": "$value", "window": wholeBucket},
+					"avg":        bson.M{"$avg": "$value", "window": wholeBucket},
+					"min":        bson.M{"$min": "$value", "window": wholeBucket},
+					"max":        bson.M{"$max": "$value", "window": wholeBucket},
+				},
+			}},
+			// The nulls are sorted before the numbers, the index is the position in the numbers
+			bson.M{"$set": bson.M{"index": bson.M{"$subtract": bson.A{
+				bson.M{"$subtract": bson.A{"$position", 1}},
+				bson.M{"$subtract": bson.A{"$count", "$valueCount"}},
+			}}}},
+			// The first document keeps the statistics of the bucket
+			bson.M{"$match": bson.M{"$expr": bson.M{"$or": append(isPicked, bson.M{"$eq": bson.A{"$position", 1}})}}},
+			bson.M{"$group": bson.M{
+				"_id":        "$bucket",
+				"count":      bson.M{"$first": "$count"},
+				"valueCount": bson.M{"$first": "$valueCount"},
+				"sum":        bson.M{"$first": "$sum"},
+				"avg":        bson.M{"$first": "$avg"},
+				"min":        bson.M{"$first": "$min"},
+				"max":        bson.M{"$first": "$max"},
+				"picks":      bson.M{"$push": bson.M{"index": "$index", "value": "$value"}},
+			}},
+			bson.M{"$sort": bson.M{"_id": 1}},
+		)
+	}
+
+	var results []aggregateResult
+	if err := models.AggregateEvents(pipeline, &results); err != nil {
+		return nil, err
+	}
+	buckets := make([]*AggregateBucket, 0, len(results))
+	for i := range results {
+		buckets = append(buckets, results[i].bucket(property, percentiles, params.Location))
+	}
+	return buckets, nil
+}
+
+// aggregateEventsInMemory is the equivalent of aggregateEvents for the backends that do not
+// support its pipeline, the events are bucketed in Go and the values of each bucket are kept.
+func aggregateEventsInMemory(params *reportParams, property *models.Property, bucket string, percentiles []float64) ([]*AggregateBucket, error) {
+	counts := make(map[time.Time]int64)
+	values := make(map[time.Time][]float64)
+	err := models.StreamEvents(params.filter(), func(event *models.Event) error {
+		start := utils.BucketStart(event.OccurredTime(), bucket, params.Location)
+		counts[start]++
+		if property == nil {
+			return nil
+		}
+		for _, pair := range event.PropertyValues {
+			if pair.Key == property.ID {
+				if value, ok := utils.ToFloat64(pair.Value); ok {
+					values[start] = append(values[start], value)
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return aggregateBuckets(counts, values, property, percentiles, params.Location), nil
+}
+
+// aggregateBuckets computes the statistics of the values of the buckets and returns the
+// buckets in the order of their start
+func aggregateBuckets(counts map[time.Time]int64, values map[time.Time][]float64, property *models.Property, percentiles []float64, loc *time.Location) []*AggregateBucket {
+	starts := make([]time.Time, 0, len(counts))
+	for start := range counts {
+		starts = append(starts, start)
+	}
+	sort.Slice(starts, func(i, j int) bool { return starts[i].Before(starts[j]) })
+
+	buckets := make([]*AggregateBucket, 0, len(starts))
+	for _, start := range starts {
+		result := aggregateResult{Start: start, Count: counts[start]}
+		sorted := sortedCopy(values[start])
+		result.ValueCount = int64(len(sorted))
+		for i, value := range sorted {
+			result.Sum += value
+			result.Picks = append(result.Picks, aggregatePick{Index: int64(i), Value: value})
+		}
+		if len(sorted) != 0 {
+			result.Avg = result.Sum / float64(len(sorted))
+			result.Min, result.Max = sorted[0], sorted[len(sorted)-1]
+		}
+		buckets = append(buckets, result.bucket(property, percentiles, loc))
+	}
+	return buckets
+}
@@ -0,0 +1,42 @@
+package services
+
+import (
+	"testing"
+	"time"
+
+	"github.com/djamysh/PensieveAPI/models"
+)
+
+func TestAggregateBuckets(t *testing.T) {
+	day := time.Date(2023, time.January, 2, 0, 0, 0, 0, time.UTC)
+	nextDay := day.AddDate(0, 0, 1)
+	counts := map[time.Time]int64{nextDay: 1, day: 4}
+	// One of the events of the first day does not have a number value
+	values := map[time.Time][]float64{day: {4, 1, 2}}
+	property := &models.Property{ValueDataType: "number"}
+
+	buckets := aggregateBuckets(counts, values, property, []float64{50, 90}, time.UTC)
+	if len(buckets) != 2 {
+		t.Fatalf("aggregateBuckets() returned %d buckets, want 2", len(buckets))
+	}
+
+	first := buckets[0]
+	if !first.Start.Equal(day) || first.Count != 4 {
+		t.Errorf("first bucket = %v with %d events, want %v with 4 events", first.Start, first.Count, day)
+	}
+	if first.Sum == nil || *first.Sum != 7 || *first.Min != 1 || *first.Max != 4 {
+		t.Errorf("first bucket statistics = %v, want sum 7, min 1 and max 4", first)
+	}
+	if got := first.Percentiles["50"]; got != 2 {
+		t.Errorf("median = %v, want 2", got)
+	}
+	if got := first.Percentiles["90"]; got != 3.6 {
+		t.Errorf("90th percentile = %v, want 3.6", got)
+	}
+
+	// The buckets without values only have the count
+	second := buckets[1]
+	if second.Count != 1 || second.Sum != nil || second.Percentiles != nil {
+		t.Errorf("second bucket = %+v, want only the count 1", second)
+	}
+}
@@ -0,0 +1,288 @@
+package services
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/djamysh/PensieveAPI/models"
+	"github.com/djamysh/PensieveAPI/utils"
+)
+
+// Baseline methods of the anomaly detection
+const (
+	AnomalyZScore = "zscore"
+	AnomalyMAD    = "mad"
+)
+
+// Minimum number of previous values to score a value against
+const minBaselineSize = 3
+
+type AnomalyOptions struct {
+	Method string
+	// Number of previous values that form the rolling baseline
+	Window int
+	// Absolute score above which a value is an outlier
+	Threshold float64
+}
+
+var DefaultAnomalyOptions = AnomalyOptions{Method: AnomalyZScore, Window: 30, Threshold: 3}
+
+var AnomalyMethodErr = &utils.EventError{Message: "Invalid anomaly method"}
+var AnomalyWindowErr = &utils.EventError{Message: "Anomaly window is too small"}
+
+type Anomaly struct {
+	EventID    string    `json:"eventID"`
+	OccurredAt time.Time `json:"occurredAt"`
+	Value      float64   `json:"value"`
+	// Mean for the z-score, median for the MAD method
+	Baseline float64 `json:"baseline"`
+	Score    float64 `json:"score"`
+}
+
+type AnomaliesResponse struct {
+	ActivityID string     `json:"activityID"`
+	PropertyID string     `json:"propertyID"`
+	Method     string     `json:"method"`
+	Window     int        `json:"window"`
+	Threshold  float64    `json:"threshold"`
+	Anomalies  []*Anomaly `json:"anomalies"`
+}
+
+func median(sorted []float64) float64 {
+	return percentile(sorted, 50)
+}
+
+// ScoreValue scores the value against the baseline values, ok is false if the
+// baseline is too small or has no spread to score against.
+func ScoreValue(value float64, baseline []float64, method string) (score, center float64, ok bool) {
+	if len(baseline) < minBaselineSize {
+		return 0, 0, false
+	}
+
+	if method == AnomalyMAD {
+		// Modified z-score, 0.6745 scales the MAD to the standard deviation of a normal distribution
+		center = median(sortedCopy(baseline))
+		deviations := make([]float64, 0, len(baseline))
+		for _, element := range baseline {
+			deviations = append(deviations, math.Abs(element-center))
+		}
+		mad := median(sortedCopy(deviations))
+		if mad == 0 {
+			return 0, center, false
+		}
+		return 0.6745 * (value - center) / mad, center, true
+	}
+
+	center = mean(baseline)
+	var variance float64
+	for _, element := range baseline {
+		variance += (element - center) * (element - center)
+	}
+	stddev := math.Sqrt(variance / float64(len(baseline)-1))
+	if stddev == 0 {
+		return 0, center, false
+	}
+	return (value - center) / stddev, center, true
+}
+
+// numberValueFilter matches the events of the activity that have a number value of the property
+func numberValueFilter(activityID, propertyID primitive.ObjectID) bson.M {
+	return bson.M{
+		"activityID":     activityID,
+		"propertyValues": bson.M{"$elemMatch": bson.M{"key": propertyID, "value": bson.M{"$type": "number"}}},
+	}
+}
+
+// eventNumberValue returns the number value of the property of the event
+func eventNumberValue(event *models.Event, propertyID primitive.ObjectID) (float64, bool) {
+	for _, pair := range event.PropertyValues {
+		if pair.Key == propertyID {
+			return utils.ToFloat64(pair.Value)
+		}
+	}
+	return 0, false
+}
+
+// rollingWindow returns the last window of the values in the order they occurred, the
+// baseline of the value that follows them. Both the report and the check of the event
+// writes score a value against the same window.
+func rollingWindow(values []float64, window int) []float64 {
+	if len(values) > window {
+		return values[len(values)-window:]
+	}
+	return values
+}
+
+// DetectAnomalies scores the values of the number property of the activity's events that
+// occurred in [from, to) against the rolling baseline of the previous values. The zero
+// from and to mean unbounded. It is usable by the other services as well as the endpoint.
+func DetectAnomalies(activityID primitive.ObjectID, property *models.Property, from, to time.Time, options AnomalyOptions) ([]*Anomaly, error) {
+	if options.Method != AnomalyZScore && options.Method != AnomalyMAD {
+		return nil, AnomalyMethodErr
+	}
+	if options.Window < minBaselineSize {
+		return nil, AnomalyWindowErr
+	}
+
+	// The events before from are fetched as well, they are the baseline of the first events
+	filter := occurredAtFilter(numberValueFilter(activityID, property.ID), time.Time{}, to)
+	events, err := models.GetEventsByFilter(filter)
+	if err != nil {
+		return nil, err
+	}
+	sortEventsByOccurrence(events)
+
+	anomalies := []*Anomaly{}
+	var values []float64
+	for i := range events {
+		value, hasValue := eventNumberValue(&events[i], property.ID)
+		if !hasValue {
+			continue
+		}
+
+		baseline := rollingWindow(values, options.Window)
+		values = append(values, value)
+
+		if !from.IsZero() && events[i].OccurredTime().Before(from) {
+			continue
+		}
+		score, center, ok := ScoreValue(value, baseline, options.Method)
+		if ok && math.Abs(score) > options.Threshold {
+			anomalies = append(anomalies, &Anomaly{
+				EventID:    events[i].ID.Hex(),
+				OccurredAt: events[i].OccurredTime(),
+				Value:      value,
+				Baseline:   center,
+				Score:      score,
+			})
+		}
+	}
+	return anomalies, nil
+}
+
+// sortEventsByOccurrence sorts the events by their occurredAt and then by their IDs, the
+// order of the recent events of the checks
+func sortEventsByOccurrence(events []models.Event) {
+	sort.Slice(events, func(i, j int) bool {
+		ti, tj := events[i].OccurredTime(), events[j].OccurredTime()
+		if ti.Equal(tj) {
+			return events[i].ID.Hex() < events[j].ID.Hex()
+		}
+		return ti.Before(tj)
+	})
+}
+
+// checkAnomalies scores the values of the number properties of the event against the previous
+// values of its activity with the default options, it returns a warning for every unusual
+// value. The anomalies are only flagged, they do not reject the event. The stored event of
+// the excludeID is left out e.g. the previous value of an updated event. Nothing is queried
+// if the event does not have a number value.
+func checkAnomalies(event *models.Event, excludeID primitive.ObjectID) ([]string, error) {
+	values := make(map[primitive.ObjectID]float64)
+	var propertyIDs bson.A
+	for _, pair := range event.PropertyValues {
+		if value, ok := utils.ToFloat64(pair.Value); ok {
+			values[pair.Key] = value
+			propertyIDs = append(propertyIDs, pair.Key)
+		}
+	}
+	if len(values) == 0 {
+		return nil, nil
+	}
+	properties, err := models.GetPropertiesByFilter(bson.M{"_id": bson.M{"$in": propertyIDs}, "valueDataType": "number"})
+	if err != nil {
+		return nil, err
+	}
+
+	window := DefaultAnomalyOptions.Window
+	var warnings []string
+	for _, property := range properties {
+		filter := numberValueFilter(event.ActivityID, property.ID)
+		filter["occurredAt"] = bson.M{"$lt": event.OccurredAt}
+		if !excludeID.IsZero() {
+			filter["_id"] = bson.M{"$ne": excludeID}
+		}
+		previousEvents, err := models.GetRecentEvents(filter, int64(window))
+		if err != nil {
+			return nil, err
+		}
+
+		// The recent events are the latest first
+		previousValues := make([]float64, 0, len(previousEvents))
+		for i := len(previousEvents) - 1; i >= 0; i-- {
+			if element, ok := eventNumberValue(&previousEvents[i], property.ID); ok {
+				previousValues = append(previousValues, element)
+			}
+		}
+
+		value := values[property.ID]
+		score, center, ok := ScoreValue(value, rollingWindow(previousValues, window), DefaultAnomalyOptions.Method)
+		if !ok || math.Abs(score) <= DefaultAnomalyOptions.Threshold {
+			continue
+		}
+		warnings = append(warnings, fmt.Sprintf("Value of %q is unusual : %v against the baseline of %v, score %.2f", property.Name, value, center, score))
+	}
+	sort.Strings(warnings)
+	return warnings, nil
+}
+
+// AnomaliesHandler returns the outlier events of an activity's number property
+// e.g. /reports/anomalies/{activityID}?property=spending&method=mad&window=30&threshold=3.5
+func AnomaliesHandler(w http.ResponseWriter, r *http.Request) {
+	params, err := parseReportParams(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	query := r.URL.Query()
+	property, err := resolveNumberProperty(query.Get("property"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	options := DefaultAnomalyOptions
+	if method := utils.CleanInput(query.Get("method")); method != "" {
+		options.Method = method
+	}
+	if value := query.Get("window"); value != "" {
+		if options.Window, err = strconv.Atoi(value); err != nil {
+			http.Error(w, "Invalid window.", http.StatusBadRequest)
+			return
+		}
+	}
+	if value := query.Get("threshold"); value != "" {
+		if options.Threshold, err = strconv.ParseFloat(value, 64); err != nil {
+			http.Error(w, "Invalid threshold.", http.StatusBadRequest)
+			return
+		}
+	}
+
+	anomalies, err := DetectAnomalies(params.ActivityID, property, params.From, params.To, options)
+	if err != nil {
+		if _, isEventErr := err.(*utils.EventError); isEventErr {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	json.NewEncoder(w).Encode(AnomaliesResponse{
+		ActivityID: params.ActivityID.Hex(),
+		PropertyID: property.ID.Hex(),
+		Method:     options.Method,
+		Window:     options.Window,
+		Threshold:  options.Threshold,
+		Anomalies:  anomalies,
+	})
+}
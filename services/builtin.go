@@ -0,0 +1,107 @@
+package services
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/djamysh/PensieveAPI/models"
+	"github.com/djamysh/PensieveAPI/utils"
+)
+
+// Bootstrap prepares the database for the API, it creates the indexes and the built-in
+// properties and backfills the timestamps and the running timers of the old documents. It
+// is run by the server and the commands that use them, not on the connection.
+func Bootstrap() error {
+	if err := models.EnsureIndexes(); err != nil {
+		return err
+	}
+	if err := models.BackfillTimestamps(); err != nil {
+		return err
+	}
+	if err := BootstrapBuiltInProperties(); err != nil {
+		return err
+	}
+	return bootstrapRunningTimers()
+}
+
+// BootstrapBuiltInProperties creates the built-in properties if they are not
+// created yet and attaches them to the activities that do not define them.
+func BootstrapBuiltInProperties() error {
+	var err error
+
+	if models.DefaultTimelingsPropertyID, err = models.DefaultTimelingsProperty(); err != nil {
+		return err
+	}
+	if models.DefaultNotePropertyID, err = models.DefaultNoteProperty(); err != nil {
+		return err
+	}
+
+	activities, err := models.GetActivities()
+	if err != nil {
+		return err
+	}
+
+	for _, activity := range activities {
+		definedProperties := ensureBuiltInProperties(activity.DefinedProperties)
+		if len(definedProperties) == len(activity.DefinedProperties) {
+			continue
+		}
+
+		// Relations must be updated before the activity, because the
+		// difference is computed from the stored definedProperties
+		if err := UpdateActivityEventRelations(activity.ID, definedProperties); err != nil {
+			return err
+		}
+		if _, err := models.UpdateActivity(activity.ID, bson.M{"definedProperties": definedProperties}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func isBuiltInProperty(propertyID primitive.ObjectID) bool {
+	for _, id := range models.BuiltInPropertyIDs() {
+		if id == propertyID {
+			return true
+		}
+	}
+	return false
+}
+
+// ensureBuiltInProperties prepends the missing built-in properties to the given definedProperties
+func ensureBuiltInProperties(definedProperties []primitive.ObjectID) []primitive.ObjectID {
+	defined := make(map[primitive.ObjectID]bool)
+	for _, id := range definedProperties {
+		defined[id] = true
+	}
+
+	result := make([]primitive.ObjectID, 0, len(definedProperties)+2)
+	for _, id := range models.BuiltInPropertyIDs() {
+		if !defined[id] {
+			result = append(result, id)
+		}
+	}
+	return append(result, definedProperties...)
+}
+
+// defaultPropertyValue returns the value of a property that is not given in the
+// request, the default timelings are filled with the given submission time.
+func defaultPropertyValue(property *models.Property, submittedAt time.Time) interface{} {
+	if property.ID == models.DefaultTimelingsPropertyID {
+		return map[string]int64{"instant": submittedAt.Unix()}
+	}
+	return TypeNullMap[property.ValueDataType]
+}
+
+// isGeneratedTimelings reports whether the given default timelings value is the
+// instant generated from the given submission time, not one set by the client.
+func isGeneratedTimelings(value interface{}, submittedAt time.Time) bool {
+	timelings, ok := utils.ToTimelings(value)
+	if !ok || len(timelings) != 1 {
+		return false
+	}
+	instant, hasInstant := timelings[TimelingInstant]
+	return hasInstant && instant == submittedAt.Unix()
+}
@@ -0,0 +1,263 @@
+package services
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"net/http"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+
+	"github.com/djamysh/PensieveAPI/models"
+	"github.com/djamysh/PensieveAPI/utils"
+)
+
+// Aggregates of the period comparison
+const (
+	AggregateCount = "count"
+	AggregateSum   = "sum"
+	AggregateAvg   = "avg"
+	AggregateMin   = "min"
+	AggregateMax   = "max"
+)
+
+// Periods that the current period is compared to
+const (
+	ComparePrevious = "previous"
+	CompareLastYear = "lastyear"
+)
+
+type PeriodValue struct {
+	From  time.Time `json:"from"`
+	To    time.Time `json:"to"`
+	Count int64     `json:"count"`
+	// Nil if the period has no values to aggregate
+	Value *float64 `json:"value"`
+}
+
+type CompareResponse struct {
+	ActivityID string       `json:"activityID"`
+	PropertyID string       `json:"propertyID,omitempty"`
+	Aggregate  string       `json:"aggregate"`
+	Timezone   string       `json:"timezone"`
+	Current    *PeriodValue `json:"current"`
+	Previous   *PeriodValue `json:"previous"`
+	Change     *float64     `json:"change"`
+	// Nil if the previous value is zero or missing
+	PercentChange *float64 `json:"percentChange"`
+}
+
+func isValidAggregate(aggregate string) bool {
+	switch aggregate {
+	case AggregateCount, AggregateSum, AggregateAvg, AggregateMin, AggregateMax:
+		return true
+	}
+	return false
+}
+
+// periodValue computes the aggregate of the activity's events that occurred in [from, to)
+func periodValue(params *reportParams, property *models.Property, aggregate string, from, to time.Time) (*PeriodValue, error) {
+	filter := occurredAtFilter(bson.M{"activityID": params.ActivityID}, from, to)
+	events, err := models.GetEventsByFilter(filter)
+	if err != nil {
+		return nil, err
+	}
+
+	period := &PeriodValue{From: from.In(params.Location), To: to.In(params.Location), Count: int64(len(events))}
+	if aggregate == AggregateCount {
+		count := float64(period.Count)
+		period.Value = &count
+		return period, nil
+	}
+
+	var values []float64
+	for i := range events {
+		for _, pair := range events[i].PropertyValues {
+			if pair.Key != property.ID {
+				continue
+			}
+			if value, ok := utils.ToFloat64(pair.Value); ok {
+				values = append(values, value)
+			}
+		}
+	}
+	if len(values) == 0 {
+		return period, nil
+	}
+
+	var result float64
+	switch aggregate {
+	case AggregateSum, AggregateAvg:
+		for _, value := range values {
+			result += value
+		}
+		if aggregate == AggregateAvg {
+			result /= float64(len(values))
+		}
+	case AggregateMin:
+		result = math.Inf(1)
+		for _, value := range values {
+			result = math.Min(result, value)
+		}
+	case AggregateMax:
+		result = math.Inf(-1)
+		for _, value := range values {
+			result = math.Max(result, value)
+		}
+	}
+	period.Value = &result
+	return period, nil
+}
+
+// yearBefore returns the same time of the previous year, Feb 29 is clamped to Feb 28 instead
+// of being normalised to Mar 1. An exclusive end at the start of Feb 29 is the end of Feb 28,
+// therefore it is the start of Mar 1.
+func yearBefore(t time.Time, loc *time.Location, isEnd bool) time.Time {
+	t = t.In(loc)
+	year, month, day := t.Date()
+	if month == time.February && day == 29 {
+		if isEnd && t.Equal(time.Date(year, month, day, 0, 0, 0, 0, loc)) {
+			return time.Date(year-1, time.March, 1, 0, 0, 0, 0, loc)
+		}
+		day = 28
+	}
+	return time.Date(year-1, month, day, t.Hour(), t.Minute(), t.Second(), 0, loc)
+}
+
+// comparedRange returns the range that [from, to) is compared to
+func comparedRange(from, to time.Time, period, compareTo string, loc *time.Location) (time.Time, time.Time) {
+	if compareTo == CompareLastYear {
+		return yearBefore(from, loc, false), yearBefore(to, loc, true)
+	}
+
+	if period != "" {
+		// The bucket that precedes the current bucket
+		previousFrom := utils.BucketStart(from.Add(-time.Second), period, loc)
+		return previousFrom, from
+	}
+	// The range with the same length that ends where the current range starts
+	return from.Add(-to.Sub(from)), from
+}
+
+// CompareHandler computes the same aggregate for two periods and returns the change.
+// The current period is either the period bucket that contains at (default now),
+// or the from/to range. It is compared to the previous period or to the same
+// period of the last year, or to the explicitly given previousFrom/previousTo range.
+// e.g. /reports/compare/{activityID}?period=week&aggregate=sum&property=duration
+func CompareHandler(w http.ResponseWriter, r *http.Request) {
+	params, err := parseReportParams(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	query := r.URL.Query()
+	aggregate := utils.CleanInput(query.Get("aggregate"))
+	if aggregate == "" {
+		aggregate = AggregateCount
+	}
+	if !isValidAggregate(aggregate) {
+		http.Error(w, "Invalid aggregate.", http.StatusBadRequest)
+		return
+	}
+
+	var property *models.Property
+	if value := query.Get("property"); value != "" {
+		if property, err = resolveNumberProperty(value); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if aggregate != AggregateCount && property == nil {
+		http.Error(w, "Aggregate requires a number property.", http.StatusBadRequest)
+		return
+	}
+
+	compareTo := utils.CleanInput(query.Get("compareTo"))
+	if compareTo == "" {
+		compareTo = ComparePrevious
+	}
+	if compareTo != ComparePrevious && compareTo != CompareLastYear {
+		http.Error(w, "Invalid compareTo.", http.StatusBadRequest)
+		return
+	}
+
+	// Resolve the current period
+	period := utils.CleanInput(query.Get("period"))
+	from, to := params.From, params.To
+	if period != "" {
+		if !utils.IsValidBucket(period) {
+			http.Error(w, "Invalid period.", http.StatusBadRequest)
+			return
+		}
+		at := time.Now()
+		if value := query.Get("at"); value != "" {
+			if at, err = utils.ParseTime(value, params.Location, false); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		from = utils.BucketStart(at, period, params.Location)
+		to = utils.NextBucket(from, period, params.Location)
+	} else if from.IsZero() || to.IsZero() {
+		http.Error(w, "Either period or from and to must be given.", http.StatusBadRequest)
+		return
+	}
+	if !from.Before(to) {
+		http.Error(w, "Invalid range, from must be before to.", http.StatusBadRequest)
+		return
+	}
+
+	// Resolve the compared period
+	previousFrom, previousTo := comparedRange(from, to, period, compareTo, params.Location)
+	if query.Get("previousFrom") != "" || query.Get("previousTo") != "" {
+		if previousFrom, previousTo, err = explicitRange(query.Get("previousFrom"), query.Get("previousTo"), params.Location); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	response := CompareResponse{
+		ActivityID: params.ActivityID.Hex(),
+		Aggregate:  aggregate,
+		Timezone:   params.Location.String(),
+	}
+	if property != nil {
+		response.PropertyID = property.ID.Hex()
+	}
+
+	if response.Current, err = periodValue(params, property, aggregate, from, to); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if response.Previous, err = periodValue(params, property, aggregate, previousFrom, previousTo); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if response.Current.Value != nil && response.Previous.Value != nil {
+		change := *response.Current.Value - *response.Previous.Value
+		response.Change = &change
+		if *response.Previous.Value != 0 {
+			percentChange := change / math.Abs(*response.Previous.Value) * 100
+			response.PercentChange = &percentChange
+		}
+	}
+
+	json.NewEncoder(w).Encode(response)
+}
+
+// explicitRange parses both bounds of an explicitly given range
+func explicitRange(fromValue, toValue string, loc *time.Location) (from, to time.Time, err error) {
+	if fromValue == "" || toValue == "" {
+		return from, to, errors.New("Both previousFrom and previousTo must be given")
+	}
+	if from, err = utils.ParseTime(fromValue, loc, false); err != nil {
+		return from, to, err
+	}
+	if to, err = utils.ParseTime(toValue, loc, true); err != nil {
+		return from, to, err
+	}
+	return from, to, nil
+}
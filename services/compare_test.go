@@ -0,0 +1,29 @@
+package services
+
+import (
+	"testing"
+	"time"
+)
+
+func TestComparedRangeLastYear(t *testing.T) {
+	date := func(year int, month time.Month, day int) time.Time {
+		return time.Date(year, month, day, 0, 0, 0, 0, time.UTC)
+	}
+	tests := []struct {
+		name             string
+		from, to         time.Time
+		wantFrom, wantTo time.Time
+	}{
+		{"month", date(2023, time.May, 1), date(2023, time.June, 1), date(2022, time.May, 1), date(2022, time.June, 1)},
+		{"leap day", date(2024, time.February, 29), date(2024, time.March, 1), date(2023, time.February, 28), date(2023, time.March, 1)},
+		{"until leap day", date(2024, time.February, 1), date(2024, time.February, 29), date(2023, time.February, 1), date(2023, time.March, 1)},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			from, to := comparedRange(test.from, test.to, "", CompareLastYear, time.UTC)
+			if !from.Equal(test.wantFrom) || !to.Equal(test.wantTo) {
+				t.Errorf("comparedRange() = %v, %v, want %v, %v", from, to, test.wantFrom, test.wantTo)
+			}
+		})
+	}
+}
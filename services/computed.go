@@ -0,0 +1,166 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/djamysh/PensieveAPI/models"
+	"github.com/djamysh/PensieveAPI/utils"
+)
+
+// Computed properties are number properties with a formula over the other
+// properties of the same event, their values are computed on every write.
+
+var ComputedValueErr = errors.New("Value of a computed property can not be given")
+
+// validateFormula checks that the formula of the computed property parses and references
+// existing number properties, or timelings properties in duration(). Computed properties
+// can not reference the other computed properties.
+func validateFormula(property *models.Property) error {
+	return validateFormulaWith(property, models.GetPropertyByName)
+}
+
+// validateFormulaWith validates the formula with the properties that the lookup finds by name
+func validateFormulaWith(property *models.Property, lookup func(name string) (*models.Property, error)) error {
+	if property.ValueDataType == "" {
+		property.ValueDataType = "number"
+	}
+	if property.ValueDataType != "number" {
+		return errors.New("Computed property must be a number property")
+	}
+
+	formula, err := utils.ParseFormula(property.Formula)
+	if err != nil {
+		return err
+	}
+
+	for _, ref := range formula.References() {
+		if ref.Name == property.Name {
+			return errors.New("Formula can not reference its own property")
+		}
+		referenced, err := lookup(ref.Name)
+		if err != nil {
+			return fmt.Errorf("Formula references unknown property %q", ref.Name)
+		}
+		if referenced.Formula != "" {
+			return fmt.Errorf("Formula can not reference computed property %q", ref.Name)
+		}
+		if ref.Duration && referenced.ValueDataType != "timelings" {
+			return fmt.Errorf("duration() requires a timelings property, %q is not", ref.Name)
+		}
+		if !ref.Duration && referenced.ValueDataType != "number" {
+			return fmt.Errorf("Formula requires number properties, %q is not", ref.Name)
+		}
+	}
+	return nil
+}
+
+// formulaDependents returns the computed properties whose formulas reference the property with the given name
+func formulaDependents(name string) ([]models.Property, error) {
+	computedProperties, err := models.GetPropertiesByFilter(bson.M{"formula": bson.M{"$exists": true, "$ne": ""}})
+	if err != nil {
+		return nil, err
+	}
+
+	var dependents []models.Property
+	for _, computedProperty := range computedProperties {
+		formula, err := utils.ParseFormula(computedProperty.Formula)
+		if err != nil {
+			continue
+		}
+		for _, ref := range formula.References() {
+			if ref.Name == name {
+				dependents = append(dependents, computedProperty)
+				break
+			}
+		}
+	}
+	return dependents, nil
+}
+
+// computeValues sets the values of the computed properties in the property values,
+// the value is nil if an input value is missing or on division by zero.
+func computeValues(propertyValues []models.PropertyValue, properties map[primitive.ObjectID]*models.Property) error {
+	values := make(map[string]interface{})
+	for _, pair := range propertyValues {
+		if property, isExist := properties[pair.Key]; isExist {
+			values[property.Name] = pair.Value
+		}
+	}
+
+	resolve := func(ref utils.FormulaRef) (float64, bool) {
+		value, isExist := values[ref.Name]
+		if !isExist {
+			return 0, false
+		}
+		if ref.Duration {
+			start, end, ok := timelingsInterval(value)
+			return float64(end - start), ok
+		}
+		return utils.ToFloat64(value)
+	}
+
+	for idx, pair := range propertyValues {
+		property, isExist := properties[pair.Key]
+		if !isExist || property.Formula == "" {
+			continue
+		}
+
+		formula, err := utils.ParseFormula(property.Formula)
+		if err != nil {
+			return err
+		}
+		if value, ok := formula.Eval(resolve); ok {
+			propertyValues[idx].Value = value
+		} else {
+			propertyValues[idx].Value = nil
+		}
+	}
+	return nil
+}
+
+// recomputeValues loads the properties of the property values and computes the computed ones
+func recomputeValues(propertyValues []models.PropertyValue) error {
+	ids := make([]primitive.ObjectID, 0, len(propertyValues))
+	for _, pair := range propertyValues {
+		ids = append(ids, pair.Key)
+	}
+
+	properties, err := models.GetPropertiesByFilter(bson.M{"_id": bson.M{"$in": ids}})
+	if err != nil {
+		return err
+	}
+	propertiesMap := make(map[primitive.ObjectID]*models.Property)
+	for i := range properties {
+		propertiesMap[properties[i].ID] = &properties[i]
+	}
+	return computeValues(propertyValues, propertiesMap)
+}
+
+// recomputePropertysEvents recomputes the events of the activities that define the property
+func recomputePropertysEvents(propertyID primitive.ObjectID) error {
+	relatedActivities, err := GetPropertysRelatedActivities(propertyID)
+	if err != nil {
+		return err
+	}
+
+	for _, relatedActivity := range relatedActivities {
+		relatedEvents, err := models.GetEventsByFilter(bson.M{"activityID": relatedActivity.ID})
+		if err != nil {
+			return err
+		}
+
+		for _, relatedEvent := range relatedEvents {
+			if err := recomputeValues(relatedEvent.PropertyValues); err != nil {
+				return err
+			}
+			if _, err := models.UpdateEvent(relatedEvent.ID, bson.M{"propertyValues": relatedEvent.PropertyValues}); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,231 @@
+package services
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/djamysh/PensieveAPI/models"
+	"github.com/djamysh/PensieveAPI/utils"
+)
+
+type AlignedDay struct {
+	// Date of the x value, the y value is from the date + lag days
+	Date string  `json:"date"`
+	X    float64 `json:"x"`
+	Y    float64 `json:"y"`
+}
+
+type CorrelationResponse struct {
+	Timezone string `json:"timezone"`
+	Lag      int    `json:"lag"`
+	// Nil if the sample is too small or one of the series is constant
+	Pearson    *float64      `json:"pearson"`
+	Spearman   *float64      `json:"spearman"`
+	SampleSize int           `json:"sampleSize"`
+	Series     []*AlignedDay `json:"series"`
+}
+
+// dailySeries is the per day series of an activity, the daily sum of the
+// property if it is given, otherwise the daily number of events.
+type dailySeries struct {
+	property *models.Property
+	days     map[time.Time]*dailyValue
+}
+
+// value returns the value of the day, the days without events are zero for the
+// event counts and missing for the property sums.
+func (series *dailySeries) value(day time.Time) (float64, bool) {
+	daily, isExist := series.days[day]
+	if series.property == nil {
+		if !isExist {
+			return 0, true
+		}
+		return float64(daily.Count), true
+	}
+	if !isExist {
+		return 0, false
+	}
+	return daily.Sum, true
+}
+
+func parseDailySeries(r *http.Request, activityParam, propertyParam string, loc *time.Location, from, to time.Time) (*dailySeries, error) {
+	query := r.URL.Query()
+	activityID, err := primitive.ObjectIDFromHex(query.Get(activityParam))
+	if err != nil {
+		return nil, err
+	}
+
+	var series dailySeries
+	if value := query.Get(propertyParam); value != "" {
+		if series.property, err = resolveNumberProperty(value); err != nil {
+			return nil, err
+		}
+	}
+
+	params := &reportParams{ActivityID: activityID, Location: loc, From: from, To: to}
+	if series.days, err = dailyValues(params, series.property); err != nil {
+		return nil, err
+	}
+	return &series, nil
+}
+
+func mean(values []float64) float64 {
+	var sum float64
+	for _, value := range values {
+		sum += value
+	}
+	return sum / float64(len(values))
+}
+
+// pearson computes the Pearson correlation coefficient, NaN if one of the series is constant
+func pearson(xs, ys []float64) float64 {
+	xMean, yMean := mean(xs), mean(ys)
+	var covariance, xVariance, yVariance float64
+	for i := range xs {
+		dx, dy := xs[i]-xMean, ys[i]-yMean
+		covariance += dx * dy
+		xVariance += dx * dx
+		yVariance += dy * dy
+	}
+	return covariance / math.Sqrt(xVariance*yVariance)
+}
+
+// ranks returns the ranks of the values, ties get the average of their ranks
+func ranks(values []float64) []float64 {
+	indexes := make([]int, len(values))
+	for i := range indexes {
+		indexes[i] = i
+	}
+	sort.Slice(indexes, func(i, j int) bool { return values[indexes[i]] < values[indexes[j]] })
+
+	result := make([]float64, len(values))
+	for i := 0; i < len(indexes); {
+		j := i
+		for j+1 < len(indexes) && values[indexes[j+1]] == values[indexes[i]] {
+			j++
+		}
+		rank := float64(i+j)/2 + 1
+		for k := i; k <= j; k++ {
+			result[indexes[k]] = rank
+		}
+		i = j + 1
+	}
+	return result
+}
+
+// spearman computes the Spearman rank correlation coefficient
+func spearman(xs, ys []float64) float64 {
+	return pearson(ranks(xs), ranks(ys))
+}
+
+// coefficient converts the NaN coefficients into nil for the JSON response
+func coefficient(value float64) *float64 {
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		return nil
+	}
+	return &value
+}
+
+// CorrelationHandler aligns two daily series by day with an optional lag in days and
+// returns their correlation. Each series is the daily sum of a number property of an
+// activity, or the daily number of events of the activity if the property is not given.
+// e.g. /reports/correlation?x={exerciseID}&y={sleepID}&yProperty=quality&lag=1
+func CorrelationHandler(w http.ResponseWriter, r *http.Request) {
+	loc, err := requestLocation(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	from, to, err := timeRange(r, loc)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	lag := 0
+	if value := r.URL.Query().Get("lag"); value != "" {
+		if lag, err = strconv.Atoi(value); err != nil {
+			http.Error(w, "Invalid lag.", http.StatusBadRequest)
+			return
+		}
+	}
+
+	xSeries, err := parseDailySeries(r, "x", "xProperty", loc, from, to)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// The y series is shifted by the lag, so its range is shifted as well
+	yFrom, yTo := from, to
+	if !yFrom.IsZero() {
+		yFrom = yFrom.In(loc).AddDate(0, 0, lag)
+	}
+	if !yTo.IsZero() {
+		yTo = yTo.In(loc).AddDate(0, 0, lag)
+	}
+	ySeries, err := parseDailySeries(r, "y", "yProperty", loc, yFrom, yTo)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// The days range, from the first to the last x day that has a pair if the range is not given
+	var first, last time.Time
+	for day := range xSeries.days {
+		if first.IsZero() || day.Before(first) {
+			first = day
+		}
+		if last.IsZero() || day.After(last) {
+			last = day
+		}
+	}
+	for day := range ySeries.days {
+		day = day.AddDate(0, 0, -lag)
+		if first.IsZero() || day.Before(first) {
+			first = day
+		}
+		if last.IsZero() || day.After(last) {
+			last = day
+		}
+	}
+	if !from.IsZero() {
+		first = utils.BucketStart(from, utils.BucketDay, loc)
+	}
+	if !to.IsZero() {
+		last = utils.BucketStart(to.Add(-time.Second), utils.BucketDay, loc)
+	}
+
+	response := CorrelationResponse{
+		Timezone: loc.String(),
+		Lag:      lag,
+		Series:   []*AlignedDay{},
+	}
+
+	var xs, ys []float64
+	if !first.IsZero() {
+		for day := first; !day.After(last); day = utils.NextBucket(day, utils.BucketDay, loc) {
+			x, hasX := xSeries.value(day)
+			y, hasY := ySeries.value(time.Date(day.Year(), day.Month(), day.Day()+lag, 0, 0, 0, 0, loc))
+			if !hasX || !hasY {
+				continue
+			}
+			xs = append(xs, x)
+			ys = append(ys, y)
+			response.Series = append(response.Series, &AlignedDay{Date: day.Format(utils.DateLayout), X: x, Y: y})
+		}
+	}
+
+	response.SampleSize = len(xs)
+	if response.SampleSize >= 3 {
+		response.Pearson = coefficient(pearson(xs, ys))
+		response.Spearman = coefficient(spearman(xs, ys))
+	}
+
+	json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,241 @@
+package services
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/djamysh/PensieveAPI/models"
+	"github.com/djamysh/PensieveAPI/utils"
+)
+
+// CSV representation of the events of an activity. Every defined property is a
+// column named by the property name, a timelings property is flattened into
+// a column per timeling key, e.g. "timelings.start", whose cells are the
+// RFC3339 times in the active timezone. Arrays are JSON encoded in a cell.
+
+const (
+	CSVColumnID         = "id"
+	CSVColumnOccurredAt = "occurredAt"
+)
+
+type csvColumn struct {
+	header   string
+	property *models.Property
+	// Timeling key of a flattened timelings column
+	timelingKey string
+}
+
+// timelingKeyOrder orders the meaningful timeling keys first and the free tags alphabetically
+func timelingKeyOrder(keys []string) {
+	rank := map[string]int{TimelingInstant: 1, TimelingStart: 2, TimelingEnd: 3}
+	sort.Slice(keys, func(i, j int) bool {
+		ri, rj := rank[keys[i]], rank[keys[j]]
+		if ri == 0 {
+			ri = len(rank) + 1
+		}
+		if rj == 0 {
+			rj = len(rank) + 1
+		}
+		if ri != rj {
+			return ri < rj
+		}
+		return keys[i] < keys[j]
+	})
+}
+
+// timelingsKeys finds the timeling keys that the matched events use for each of the timelings properties
+func timelingsKeys(filter bson.M, propertyIDs []primitive.ObjectID) (map[primitive.ObjectID][]string, error) {
+	pipeline := []bson.M{
+		{"$match": filter},
+		{"$unwind": "$propertyValues"},
+		{"$match": bson.M{"propertyValues.key": bson.M{"$in": propertyIDs}, "propertyValues.value": bson.M{"$type": "object"}}},
+		{"$project": bson.M{"key": "$propertyValues.key", "timelings": bson.M{"$objectToArray": "$propertyValues.value"}}},
+		{"$unwind": "$timelings"},
+		{"$group": bson.M{"_id": bson.M{"key": "$key", "timeling": "$timelings.k"}}},
+	}
+
+	var results []struct {
+		ID struct {
+			Key      primitive.ObjectID `bson:"key"`
+			Timeling string             `bson:"timeling"`
+		} `bson:"_id"`
+	}
+	if err := models.AggregateEvents(pipeline, &results); err != nil {
+		return nil, err
+	}
+
+	keys := make(map[primitive.ObjectID][]string)
+	for _, result := range results {
+		keys[result.ID.Key] = append(keys[result.ID.Key], result.ID.Timeling)
+	}
+	for _, timelings := range keys {
+		timelingKeyOrder(timelings)
+	}
+	return keys, nil
+}
+
+// csvColumns returns the columns of the defined properties of the activity in their defined order
+func csvColumns(activity *models.Activity, filter bson.M) ([]csvColumn, error) {
+	properties, err := models.GetPropertiesByFilter(bson.M{"_id": bson.M{"$in": activity.DefinedProperties}})
+	if err != nil {
+		return nil, err
+	}
+	propertiesMap := make(map[primitive.ObjectID]*models.Property)
+	var timelingsProperties []primitive.ObjectID
+	for i := range properties {
+		propertiesMap[properties[i].ID] = &properties[i]
+		if properties[i].ValueDataType == "timelings" {
+			timelingsProperties = append(timelingsProperties, properties[i].ID)
+		}
+	}
+
+	keys, err := timelingsKeys(filter, timelingsProperties)
+	if err != nil {
+		return nil, err
+	}
+
+	var columns []csvColumn
+	for _, propertyID := range activity.DefinedProperties {
+		property, isExist := propertiesMap[propertyID]
+		if !isExist {
+			continue
+		}
+		if property.ValueDataType != "timelings" {
+			columns = append(columns, csvColumn{header: property.Name, property: property})
+			continue
+		}
+
+		timelings := keys[propertyID]
+		if len(timelings) == 0 {
+			// The column of the default key is kept even if no event has it yet
+			timelings = []string{TimelingInstant}
+		}
+		for _, key := range timelings {
+			columns = append(columns, csvColumn{header: property.Name + "." + key, property: property, timelingKey: key})
+		}
+	}
+	return columns, nil
+}
+
+// csvCell formats a property value of the column
+func csvCell(column csvColumn, value interface{}, loc *time.Location) string {
+	if value == nil {
+		return ""
+	}
+
+	switch column.property.ValueDataType {
+	case "timelings":
+		timelings, ok := utils.ToTimelings(value)
+		if !ok {
+			return ""
+		}
+		timestamp, isExist := timelings[column.timelingKey]
+		if !isExist {
+			return ""
+		}
+		return time.Unix(timestamp, 0).In(loc).Format(time.RFC3339)
+	case "number":
+		if number, ok := utils.ToFloat64(value); ok {
+			return strconv.FormatFloat(number, 'f', -1, 64)
+		}
+	case "string":
+		if str, ok := value.(string); ok {
+			return str
+		}
+	case "string array":
+		if strs, ok := utils.ToStrings(value); ok {
+			encoded, _ := json.Marshal(strs)
+			return string(encoded)
+		}
+	case "number array":
+		numbers, ok := utils.ToFloat64s(value)
+		if !ok || numbers == nil {
+			numbers = []float64{}
+		}
+		encoded, _ := json.Marshal(numbers)
+		return string(encoded)
+	}
+	return fmt.Sprint(value)
+}
+
+// ExportEventsCSVHandler streams the events of the activity as CSV, the events
+// are written as they are read from the cursor.
+// e.g. /export/csv/{activityID}?from=2023-01-01&to=2023-02-01&tz=Europe/Istanbul
+func ExportEventsCSVHandler(w http.ResponseWriter, r *http.Request) {
+	activityID, err := primitive.ObjectIDFromHex(mux.Vars(r)["activityID"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	activity, err := models.GetActivity(activityID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	loc, err := requestLocation(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	filter, err := eventsFilter(r, bson.M{"activityID": activityID})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	columns, err := csvColumns(activity, filter)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	header := []string{CSVColumnID, CSVColumnOccurredAt}
+	for _, column := range columns {
+		header = append(header, column.header)
+	}
+
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", activity.Name+".csv"))
+
+	writer := csv.NewWriter(w)
+	if err := writer.Write(header); err != nil {
+		return
+	}
+
+	// The status is already sent, an error while streaming can only cut the response
+	flusher, _ := w.(http.Flusher)
+	count := 0
+	err = models.StreamEvents(filter, func(event *models.Event) error {
+		values := PropertyValueBackConvertion(event.PropertyValues)
+		record := []string{event.ID.Hex(), event.OccurredTime().In(loc).Format(time.RFC3339)}
+		for _, column := range columns {
+			record = append(record, csvCell(column, values[column.property.ID], loc))
+		}
+		if err := writer.Write(record); err != nil {
+			return err
+		}
+
+		if count++; count%500 == 0 {
+			writer.Flush()
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+		return writer.Error()
+	})
+	writer.Flush()
+	if err != nil {
+		log.Println("CSV export of", activityID.Hex(), "is interrupted:", err)
+	}
+}
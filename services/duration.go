@@ -0,0 +1,231 @@
+package services
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/djamysh/PensieveAPI/models"
+	"github.com/djamysh/PensieveAPI/utils"
+)
+
+type DurationBucket struct {
+	Start   time.Time `json:"start"`
+	Seconds int64     `json:"seconds"`
+}
+
+type DurationTotal struct {
+	ActivityID   string `json:"activityID"`
+	ActivityName string `json:"activityName"`
+	// Value of the groupBy property, only given if the report is grouped
+	Group   *string           `json:"group,omitempty"`
+	Seconds int64             `json:"seconds"`
+	Buckets []*DurationBucket `json:"buckets"`
+}
+
+type DurationsResponse struct {
+	Bucket     string           `json:"bucket"`
+	Timezone   string           `json:"timezone"`
+	GroupBy    string           `json:"groupBy,omitempty"`
+	Activities []*DurationTotal `json:"activities"`
+}
+
+// splitInterval splits the interval [start, end) into the buckets that it crosses, e.g.
+// a sleep over midnight is split into the two days by the seconds that fall into each day.
+func splitInterval(start, end time.Time, bucket string, loc *time.Location) map[time.Time]int64 {
+	seconds := make(map[time.Time]int64)
+	for bucketStart := utils.BucketStart(start, bucket, loc); bucketStart.Before(end); {
+		bucketEnd := utils.NextBucket(bucketStart, bucket, loc)
+
+		from, to := start, end
+		if bucketStart.After(from) {
+			from = bucketStart
+		}
+		if bucketEnd.Before(to) {
+			to = bucketEnd
+		}
+		if to.After(from) {
+			seconds[bucketStart] += int64(to.Sub(from) / time.Second)
+		}
+		bucketStart = bucketEnd
+	}
+	return seconds
+}
+
+// stringValues returns the values of a string or a string array property value
+func stringValues(value interface{}) []string {
+	if str, ok := value.(string); ok {
+		return []string{str}
+	}
+	strs, _ := utils.ToStrings(value)
+	return strs
+}
+
+// uniqueStrings returns the values without the repeated ones, in the order they first appear
+func uniqueStrings(values []string) []string {
+	seen := make(map[string]bool, len(values))
+	unique := make([]string, 0, len(values))
+	for _, value := range values {
+		if !seen[value] {
+			seen[value] = true
+			unique = append(unique, value)
+		}
+	}
+	return unique
+}
+
+// DurationsHandler sums the tracked time of the interval events per activity per bucket.
+// Optionally grouped by a string or string array property, an event with multiple
+// values in a string array property is counted for each of its values.
+// e.g. /reports/durations?bucket=week&from=2023-01-01&activityID=...&groupBy=subject
+func DurationsHandler(w http.ResponseWriter, r *http.Request) {
+	params, err := parseReportParams(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	query := r.URL.Query()
+	bucket := utils.CleanInput(query.Get("bucket"))
+	if bucket == "" {
+		bucket = utils.BucketDay
+	}
+	if !utils.IsValidBucket(bucket) {
+		http.Error(w, "Invalid bucket.", http.StatusBadRequest)
+		return
+	}
+
+	var groupBy *models.Property
+	if value := query.Get("groupBy"); value != "" {
+		if groupBy, err = resolveProperty(value); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if groupBy.ValueDataType != "string" && groupBy.ValueDataType != "string array" {
+			http.Error(w, "Group by property must be a string or string array property.", http.StatusBadRequest)
+			return
+		}
+	}
+
+	// The range applies to the intervals instead of the occurredAt
+	elemMatch := bson.M{
+		"key":         models.DefaultTimelingsPropertyID,
+		"value.start": bson.M{"$exists": true},
+		"value.end":   bson.M{"$exists": true},
+	}
+	if !params.To.IsZero() {
+		elemMatch["value.start"] = bson.M{"$lt": params.To.Unix()}
+	}
+	if !params.From.IsZero() {
+		elemMatch["value.end"] = bson.M{"$gt": params.From.Unix()}
+	}
+	filter := bson.M{"propertyValues": bson.M{"$elemMatch": elemMatch}}
+	if !params.ActivityID.IsZero() {
+		filter["activityID"] = params.ActivityID
+	}
+
+	events, err := models.GetEventsByFilter(filter)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	type totalKey struct {
+		activityID primitive.ObjectID
+		group      string
+	}
+	totals := make(map[totalKey]map[time.Time]int64)
+
+	for i := range events {
+		start, end, ok := eventInterval(&events[i])
+		if !ok {
+			continue
+		}
+
+		// Clip the interval into the requested range
+		startTime, endTime := time.Unix(start, 0), time.Unix(end, 0)
+		if !params.From.IsZero() && startTime.Before(params.From) {
+			startTime = params.From
+		}
+		if !params.To.IsZero() && endTime.After(params.To) {
+			endTime = params.To
+		}
+
+		groups := []string{""}
+		if groupBy != nil {
+			groups = nil
+			for _, pair := range events[i].PropertyValues {
+				if pair.Key == groupBy.ID {
+					// An interval is counted once for each distinct value
+					groups = uniqueStrings(stringValues(pair.Value))
+				}
+			}
+			if len(groups) == 0 {
+				// Events without a value are grouped under the empty string
+				groups = []string{""}
+			}
+		}
+
+		for bucketStart, seconds := range splitInterval(startTime, endTime, bucket, params.Location) {
+			for _, group := range groups {
+				key := totalKey{activityID: events[i].ActivityID, group: group}
+				if totals[key] == nil {
+					totals[key] = make(map[time.Time]int64)
+				}
+				totals[key][bucketStart] += seconds
+			}
+		}
+	}
+
+	response := DurationsResponse{
+		Bucket:     bucket,
+		Timezone:   params.Location.String(),
+		Activities: make([]*DurationTotal, 0, len(totals)),
+	}
+	if groupBy != nil {
+		response.GroupBy = groupBy.ID.Hex()
+	}
+
+	activityNames := make(map[primitive.ObjectID]string)
+	for key, buckets := range totals {
+		name, isExist := activityNames[key.activityID]
+		if !isExist {
+			if activity, err := models.GetActivity(key.activityID); err == nil {
+				name = activity.Name
+			}
+			activityNames[key.activityID] = name
+		}
+
+		total := &DurationTotal{
+			ActivityID:   key.activityID.Hex(),
+			ActivityName: name,
+			Buckets:      make([]*DurationBucket, 0, len(buckets)),
+		}
+		if groupBy != nil {
+			group := key.group
+			total.Group = &group
+		}
+		for bucketStart, seconds := range buckets {
+			total.Seconds += seconds
+			total.Buckets = append(total.Buckets, &DurationBucket{Start: bucketStart, Seconds: seconds})
+		}
+		sort.Slice(total.Buckets, func(i, j int) bool { return total.Buckets[i].Start.Before(total.Buckets[j].Start) })
+
+		response.Activities = append(response.Activities, total)
+	}
+
+	// Deterministic order, by activity name and then by group
+	sort.Slice(response.Activities, func(i, j int) bool {
+		a, b := response.Activities[i], response.Activities[j]
+		if a.ActivityName != b.ActivityName {
+			return a.ActivityName < b.ActivityName
+		}
+		return a.Group != nil && b.Group != nil && *a.Group < *b.Group
+	})
+
+	json.NewEncoder(w).Encode(response)
+}
@@ -18,6 +18,9 @@ import (
 type CreateEventRequest struct {
 	ActivityID     string                 `json:"activityID"`
 	PropertyValues map[string]interface{} `json:"propertyValues"`
+	// Optional, defaults to the submission time on creation and
+	// to the previous value on update.
+	OccurredAt *time.Time `json:"occurredAt"`
 }
 
 var TypeErr = &utils.EventError{Message: "Invalid data type"}
@@ -36,6 +39,25 @@ func getType(valueType string) reflect.Type {
 	return reflect.TypeOf(TypeNullMap[valueType])
 }
 
+// checkPropertyValue checks the data type of the given value of the property, the timelings
+// are validated and converted into map[string]int64 instead of the JSON decoded floats.
+func checkPropertyValue(property *models.Property, value interface{}) (interface{}, error) {
+	// Determine the data type
+	valueType := reflect.TypeOf(value)
+
+	// If the given value's data type is not valid
+	if valueType == nil || getType(property.ValueDataType).Name() != valueType.Name() {
+		msg := fmt.Sprintf("PropertyID : %s, Given Property Value Type : %s Expected Property Value Type : %s ", property.ID, valueType, getType(property.ValueDataType).Name())
+		return nil, errors.New(msg)
+	}
+
+	// Checking wheter the given timeling is valid or not
+	if property.ValueDataType == "timelings" {
+		return ParseTimelings(value)
+	}
+	return value, nil
+}
+
 // TODO: Implement a cache for inner calls to increase performance, use redis.
 
 // TODO: Improve this function,
@@ -58,7 +80,14 @@ func ControlEvent(event *CreateEventRequest, previousEvent *models.Event) (*mode
 		return nil, err
 	}
 
+	// The moment that is used to fill the default timelings
+	submittedAt := time.Now().UTC()
+	if event.OccurredAt != nil {
+		submittedAt = event.OccurredAt.UTC()
+	}
+
 	undefinedProperties := make(map[primitive.ObjectID]*models.Property)
+	definedProperties := make(map[primitive.ObjectID]*models.Property)
 
 	// Checking data type consistency with given property values' data types
 	// TODO: make neater way of error response
@@ -68,6 +97,7 @@ func ControlEvent(event *CreateEventRequest, previousEvent *models.Event) (*mode
 		if err != nil {
 			return nil, err
 		}
+		definedProperties[propertyID] = property
 
 		// Get the corresponding value
 
@@ -77,34 +107,18 @@ func ControlEvent(event *CreateEventRequest, previousEvent *models.Event) (*mode
 		if !isPresent {
 			undefinedProperties[propertyID] = property
 
-		} else {
-
-			// Determine the data type
-			valueType := reflect.TypeOf(propertyValue)
-
-			// If the given value's data type is valid
-			if getType(property.ValueDataType).Name() == valueType.Name() {
-
-				// if the property is timelings
-				if valueType == getType("timelings") {
+		} else if property.Formula != "" {
+			// Computed values are set by the server
+			return nil, ComputedValueErr
 
-					// Checking wheter the given timeling is valid or not
-					for _, timeling := range propertyValue.(map[string]int64) {
-						if time.Unix(timeling, 0).IsZero() {
-							return nil, TimestampErr // given timestamp is not valid
-						}
-					}
-				}
-
-				continue
-
-			} else {
-				msg := fmt.Sprintf("PropertyID : %s, Given Property Value Type : %s Expected Property Value Type : %s ", propertyID, reflect.TypeOf(propertyValue), getType(property.ValueDataType).Name())
-				return nil, errors.New(msg)
+		} else {
 
-				// return TypeErr
+			// Checking the data type of the given value
+			value, err := checkPropertyValue(property, propertyValue)
+			if err != nil {
+				return nil, err
 			}
-
+			event.PropertyValues[propertyID.Hex()] = value
 		}
 
 	}
@@ -137,10 +151,10 @@ func ControlEvent(event *CreateEventRequest, previousEvent *models.Event) (*mode
 		// Create Event call
 		for propertyID, property := range undefinedProperties {
 
-			// Setting the null element
+			// Setting the null element, or the submission time for the default timelings
 			element := models.PropertyValue{
 				Key:   propertyID,
-				Value: TypeNullMap[property.ValueDataType],
+				Value: defaultPropertyValue(property, submittedAt),
 			}
 
 			// Appending to the propertyValuesSlice
@@ -156,24 +170,75 @@ func ControlEvent(event *CreateEventRequest, previousEvent *models.Event) (*mode
 
 			// if it is append the pair to propertyValuesSlice
 			if isExist {
+				// The generated default timelings follows the new occurredAt
+				if pair.Key == models.DefaultTimelingsPropertyID && event.OccurredAt != nil &&
+					isGeneratedTimelings(pair.Value, previousEvent.OccurredTime()) {
+					pair.Value = defaultPropertyValue(undefinedProperties[pair.Key], submittedAt)
+				}
 				propertyValuesSlice = append(propertyValuesSlice, pair)
 			}
 		}
 
 	}
 
+	// Compute the values of the computed properties from the other values
+	if err := computeValues(propertyValuesSlice, definedProperties); err != nil {
+		return nil, err
+	}
+
 	// Pass the processed data into the new model.
 	var checkedEvent models.Event
 	checkedEvent.ActivityID = activityID
 	checkedEvent.PropertyValues = propertyValuesSlice
 
+	if event.OccurredAt != nil {
+		if event.OccurredAt.IsZero() {
+			return nil, TimestampErr
+		}
+		checkedEvent.OccurredAt = event.OccurredAt.UTC()
+	} else if previousEvent != nil {
+		checkedEvent.OccurredAt = previousEvent.OccurredTime()
+	} else {
+		checkedEvent.OccurredAt = submittedAt
+	}
+
 	return &checkedEvent, nil
 }
 
+// checkEventRules checks the event against the running timer, the overlap policy and the
+// limit goals of its activity and flags its unusual values, the stored event of the excludeID
+// is left out e.g. the previous value of an updated event. It returns the warnings or an
+// *utils.EventError of the rejected event.
+func checkEventRules(event *models.Event, excludeID primitive.ObjectID, loc *time.Location) ([]string, error) {
+	if err := checkRunningTimer(event, excludeID); err != nil {
+		return nil, err
+	}
+	warnings, err := checkOverlap(event, excludeID)
+	if err != nil {
+		return nil, err
+	}
+	limitWarnings, err := checkLimits(event, excludeID, loc)
+	if err != nil {
+		return nil, err
+	}
+	anomalyWarnings, err := checkAnomalies(event, excludeID)
+	if err != nil {
+		return nil, err
+	}
+	warnings = append(warnings, limitWarnings...)
+	return append(warnings, anomalyWarnings...), nil
+}
+
 func CreateEventHandler(w http.ResponseWriter, r *http.Request) {
+	expander, err := newExpander(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
 	// Parse the request body
 	var request CreateEventRequest
-	err := json.NewDecoder(r.Body).Decode(&request)
+	err = json.NewDecoder(r.Body).Decode(&request)
 	if err != nil {
 		// Handle error
 		http.Error(w, err.Error(), http.StatusBadRequest)
@@ -188,17 +253,49 @@ func CreateEventHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Call the CreateEvent function
-	event, err = models.CreateEvent(event.ActivityID, event.PropertyValues)
+	// Limit goals of the activity in the period of the event
+	loc, err := requestLocation(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	warnings, err := checkEventRules(event, primitive.NilObjectID, loc)
 	if err != nil {
+		if _, isEventErr := err.(*utils.EventError); isEventErr {
+			http.Error(w, err.Error(), http.StatusConflict)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	// Call the CreateEvent function
+	event, err = models.CreateEvent(event.ActivityID, event.OccurredAt, event.PropertyValues)
+	if err == models.RunningTimerErr {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	} else if err != nil {
 		// Handle error
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	json.NewEncoder(w).Encode(event)
+
+	response, err := expander.Event(event)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	response.Warnings = warnings
+	json.NewEncoder(w).Encode(response)
 }
 
 func GetEventHandler(w http.ResponseWriter, r *http.Request) {
+	expander, err := newExpander(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
 	// Get the property ID from the URL
 	vars := mux.Vars(r)
 	id, err := primitive.ObjectIDFromHex(vars["id"])
@@ -214,21 +311,53 @@ func GetEventHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Send the property as a response
-	json.NewEncoder(w).Encode(event)
+	// Inline the requested related documents
+	response, err := expander.Event(event)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Send the event as a response
+	json.NewEncoder(w).Encode(response)
 }
 
 // GetEventsHandler retrieves a list of events and returns them as a response
 func GetEventsHandler(w http.ResponseWriter, r *http.Request) {
-	events, err := models.GetEvents()
+	expander, err := newExpander(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Optional from/to range of the occurredAt
+	filter, err := eventsFilter(r, bson.M{})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	events, err := models.GetEventsByFilter(filter)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	json.NewEncoder(w).Encode(events)
+
+	responses, err := expander.Events(events)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(responses)
 }
 
 func GetEventsByActivityID(w http.ResponseWriter, r *http.Request) {
+	expander, err := newExpander(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
 	// Get the activity ID from the URL
 	vars := mux.Vars(r)
 	activityID, err := primitive.ObjectIDFromHex(vars["activityID"])
@@ -237,12 +366,25 @@ func GetEventsByActivityID(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	events, err := models.GetEventsByFilter(bson.M{"activityID": activityID})
+	// Optional from/to range of the occurredAt
+	filter, err := eventsFilter(r, bson.M{"activityID": activityID})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	events, err := models.GetEventsByFilter(filter)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	json.NewEncoder(w).Encode(events)
+
+	responses, err := expander.Events(events)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(responses)
 }
 
 // TODO:Consider a better name
@@ -290,6 +432,10 @@ func GetNullRequestPropertyValue(activityID string) (map[string]interface{}, err
 		if err != nil {
 			return nil, err
 		}
+		if property.Formula != "" {
+			// Computed values can not be given, they are computed by ControlEvent
+			continue
+		}
 		propertyValues[propertyID.Hex()] = TypeNullMap[property.ValueDataType]
 	}
 	return propertyValues, nil
@@ -298,6 +444,12 @@ func GetNullRequestPropertyValue(activityID string) (map[string]interface{}, err
 // UpdateEventHandler updates a specific event based on
 // the passed ID and returns the old event as a response
 func UpdateEventHandler(w http.ResponseWriter, r *http.Request) {
+	expander, err := newExpander(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
 	vars := mux.Vars(r)
 
 	id, err := primitive.ObjectIDFromHex(vars["id"])
@@ -335,9 +487,13 @@ func UpdateEventHandler(w http.ResponseWriter, r *http.Request) {
 	if updateEvent.PropertyValues == nil {
 		// If the given activityID is the same with previous
 		if updateEvent.ActivityID == previousEvent.ActivityID.Hex() {
-			//TODO: Return a response that nothing updated
-			w.WriteHeader(http.StatusNoContent)
-			return
+			if updateEvent.OccurredAt == nil {
+				//TODO: Return a response that nothing updated
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+			// Only the occurredAt is updated, previous property values are kept
+			updateEvent.PropertyValues = make(map[string]interface{})
 		} else {
 			nullPropertyValues, err := GetNullRequestPropertyValue(updateEvent.ActivityID)
 			if err != nil {
@@ -355,16 +511,39 @@ func UpdateEventHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Limit goals of the activity in the period of the updated event
+	loc, err := requestLocation(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	warnings, err := checkEventRules(event, id, loc)
+	if err != nil {
+		if _, isEventErr := err.(*utils.EventError); isEventErr {
+			http.Error(w, err.Error(), http.StatusConflict)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
 	//TODO: Consider AppendUpdate for array data types,
 
-	update := bson.M{"activityID": event.ActivityID, "propertyValues": event.PropertyValues}
+	update := bson.M{"activityID": event.ActivityID, "propertyValues": event.PropertyValues, "occurredAt": event.OccurredAt}
 
 	oldEvent, err := models.UpdateEvent(id, update)
+	if err != nil {
+		http.Error(w, err.Error(), eventWriteStatus(err))
+		return
+	}
+
+	response, err := expander.Event(oldEvent)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	json.NewEncoder(w).Encode(oldEvent)
+	response.Warnings = warnings
+	json.NewEncoder(w).Encode(response)
 }
 
 func DeleteEventHandler(w http.ResponseWriter, r *http.Request) {
@@ -0,0 +1,38 @@
+package services
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/djamysh/PensieveAPI/models"
+)
+
+func TestCheckPropertyValue(t *testing.T) {
+	tests := []struct {
+		name      string
+		valueType string
+		value     interface{}
+		want      interface{}
+		wantErr   bool
+	}{
+		{"number", "number", float64(5), float64(5), false},
+		{"string", "string", "note", "note", false},
+		{"string array", "string array", []interface{}{"a", "b"}, []interface{}{"a", "b"}, false},
+		{"timelings", "timelings", map[string]interface{}{TimelingInstant: float64(100)}, map[string]int64{TimelingInstant: 100}, false},
+		{"number as string", "string", float64(5), nil, true},
+		{"string as number", "number", "5", nil, true},
+		{"invalid interval", "timelings", map[string]interface{}{TimelingStart: float64(200), TimelingEnd: float64(100)}, nil, true},
+		{"null", "number", nil, nil, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := checkPropertyValue(&models.Property{ValueDataType: test.valueType}, test.value)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("checkPropertyValue(%v) returned the error %v, want an error: %v", test.value, err, test.wantErr)
+			}
+			if err == nil && !reflect.DeepEqual(got, test.want) {
+				t.Errorf("checkPropertyValue(%v) = %v, want %v", test.value, got, test.want)
+			}
+		})
+	}
+}
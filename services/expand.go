@@ -0,0 +1,223 @@
+package services
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/djamysh/PensieveAPI/models"
+)
+
+// Valid values of the expand query parameter, e.g. /events/{id}?expand=activity,properties.
+// The goals are the referencing entities of the activity, they are inlined on request too.
+const (
+	ExpandActivity   = "activity"
+	ExpandProperties = "properties"
+	ExpandGoals      = "goals"
+)
+
+var expandFields = []string{ExpandActivity, ExpandProperties, ExpandGoals}
+
+// EventResponse is the JSON representation of an event, the related
+// documents are only inlined when they are requested with the expand parameter.
+type EventResponse struct {
+	*models.Event
+	// Durations of the interval timelings in seconds, keyed by property ID
+	Durations  map[string]int64            `json:"durations,omitempty"`
+	Activity   *models.Activity            `json:"activity,omitempty"`
+	Properties map[string]*models.Property `json:"properties,omitempty"`
+	// Goals of the activity of the event
+	Goals    []models.Goal `json:"goals,omitempty"`
+	Warnings []string      `json:"warnings,omitempty"`
+}
+
+// ActivityResponse is the JSON representation of an activity, the property
+// definitions and the goals are only inlined when they are requested with the expand parameter.
+type ActivityResponse struct {
+	*models.Activity
+	Properties []*models.Property `json:"properties,omitempty"`
+	Goals      []models.Goal      `json:"goals,omitempty"`
+}
+
+// expander inlines the related documents into the responses, it caches
+// the fetched documents so that a list response does not query the same
+// activity or property over and over again.
+type expander struct {
+	fields     map[string]bool
+	activities map[primitive.ObjectID]*models.Activity
+	properties map[primitive.ObjectID]*models.Property
+	goals      map[primitive.ObjectID][]models.Goal
+}
+
+// newExpander parses the expand parameter of the request, an unknown value is an error.
+// It is created before the request changes anything so an invalid parameter changes nothing.
+func newExpander(r *http.Request) (*expander, error) {
+	fields := make(map[string]bool)
+	for _, field := range strings.Split(r.URL.Query().Get("expand"), ",") {
+		if field = strings.TrimSpace(field); field == "" {
+			continue
+		}
+		if !isExpandField(field) {
+			return nil, fmt.Errorf("Invalid expand value %q, it must be one of %s.", field, strings.Join(expandFields, ", "))
+		}
+		fields[field] = true
+	}
+
+	return &expander{
+		fields:     fields,
+		activities: make(map[primitive.ObjectID]*models.Activity),
+		properties: make(map[primitive.ObjectID]*models.Property),
+		goals:      make(map[primitive.ObjectID][]models.Goal),
+	}, nil
+}
+
+func isExpandField(field string) bool {
+	for _, valid := range expandFields {
+		if field == valid {
+			return true
+		}
+	}
+	return false
+}
+
+func (e *expander) activity(id primitive.ObjectID) (*models.Activity, error) {
+	if activity, isExist := e.activities[id]; isExist {
+		return activity, nil
+	}
+
+	activity, err := models.GetActivity(id)
+	if err != nil {
+		return nil, err
+	}
+	e.activities[id] = activity
+	return activity, nil
+}
+
+// activityGoals returns the goals of the activity
+func (e *expander) activityGoals(activityID primitive.ObjectID) ([]models.Goal, error) {
+	if goals, isExist := e.goals[activityID]; isExist {
+		return goals, nil
+	}
+
+	goals, err := models.GetGoalsByFilter(bson.M{"activityID": activityID})
+	if err != nil {
+		return nil, err
+	}
+	e.goals[activityID] = goals
+	return goals, nil
+}
+
+// loadProperties fetches the not yet cached properties with a single query
+func (e *expander) loadProperties(ids []primitive.ObjectID) error {
+	missing := make([]primitive.ObjectID, 0, len(ids))
+	for _, id := range ids {
+		if _, isExist := e.properties[id]; !isExist {
+			missing = append(missing, id)
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+
+	properties, err := models.GetPropertiesByFilter(bson.M{"_id": bson.M{"$in": missing}})
+	if err != nil {
+		return err
+	}
+	for i := range properties {
+		e.properties[properties[i].ID] = &properties[i]
+	}
+	return nil
+}
+
+func (e *expander) Event(event *models.Event) (*EventResponse, error) {
+	response := &EventResponse{Event: event, Durations: eventDurations(event)}
+
+	if e.fields[ExpandActivity] {
+		activity, err := e.activity(event.ActivityID)
+		if err != nil {
+			return nil, err
+		}
+		response.Activity = activity
+	}
+
+	if e.fields[ExpandProperties] {
+		ids := make([]primitive.ObjectID, 0, len(event.PropertyValues))
+		for _, pair := range event.PropertyValues {
+			ids = append(ids, pair.Key)
+		}
+		if err := e.loadProperties(ids); err != nil {
+			return nil, err
+		}
+
+		response.Properties = make(map[string]*models.Property)
+		for _, id := range ids {
+			if property, isExist := e.properties[id]; isExist {
+				response.Properties[id.Hex()] = property
+			}
+		}
+	}
+
+	if e.fields[ExpandGoals] {
+		goals, err := e.activityGoals(event.ActivityID)
+		if err != nil {
+			return nil, err
+		}
+		response.Goals = goals
+	}
+
+	return response, nil
+}
+
+func (e *expander) Events(events []models.Event) ([]*EventResponse, error) {
+	responses := make([]*EventResponse, 0, len(events))
+	for i := range events {
+		response, err := e.Event(&events[i])
+		if err != nil {
+			return nil, err
+		}
+		responses = append(responses, response)
+	}
+	return responses, nil
+}
+
+func (e *expander) Activity(activity *models.Activity) (*ActivityResponse, error) {
+	response := &ActivityResponse{Activity: activity}
+
+	if e.fields[ExpandProperties] {
+		if err := e.loadProperties(activity.DefinedProperties); err != nil {
+			return nil, err
+		}
+
+		response.Properties = make([]*models.Property, 0, len(activity.DefinedProperties))
+		for _, id := range activity.DefinedProperties {
+			if property, isExist := e.properties[id]; isExist {
+				response.Properties = append(response.Properties, property)
+			}
+		}
+	}
+
+	if e.fields[ExpandGoals] {
+		goals, err := e.activityGoals(activity.ID)
+		if err != nil {
+			return nil, err
+		}
+		response.Goals = goals
+	}
+
+	return response, nil
+}
+
+func (e *expander) Activities(activities []*models.Activity) ([]*ActivityResponse, error) {
+	responses := make([]*ActivityResponse, 0, len(activities))
+	for _, activity := range activities {
+		response, err := e.Activity(activity)
+		if err != nil {
+			return nil, err
+		}
+		responses = append(responses, response)
+	}
+	return responses, nil
+}
@@ -0,0 +1,32 @@
+package services
+
+import (
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestNewExpander(t *testing.T) {
+	tests := []struct {
+		query   string
+		want    map[string]bool
+		wantErr bool
+	}{
+		{"", map[string]bool{}, false},
+		{"?expand=activity", map[string]bool{ExpandActivity: true}, false},
+		{"?expand=activity,%20properties,,goals", map[string]bool{ExpandActivity: true, ExpandProperties: true, ExpandGoals: true}, false},
+		{"?expand=activity,events", nil, true},
+		{"?expand=Activity", nil, true},
+	}
+	for _, test := range tests {
+		t.Run(test.query, func(t *testing.T) {
+			expander, err := newExpander(httptest.NewRequest("GET", "/events"+test.query, nil))
+			if (err != nil) != test.wantErr {
+				t.Fatalf("newExpander() returned the error %v, want an error: %v", err, test.wantErr)
+			}
+			if err == nil && !reflect.DeepEqual(expander.fields, test.want) {
+				t.Errorf("fields = %v, want %v", expander.fields, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,92 @@
+package services
+
+import (
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/djamysh/PensieveAPI/models"
+)
+
+const defaultFacetLimit = 50
+
+type Facet struct {
+	Value string `bson:"_id" json:"value"`
+	Count int64  `bson:"count" json:"count"`
+}
+
+type FacetsResponse struct {
+	PropertyID string   `json:"propertyID"`
+	Facets     []*Facet `json:"facets"`
+}
+
+// FacetsHandler returns the distinct values of a string or string array property
+// with the number of events that use them, the most used first. The prefix
+// parameter filters the values case insensitively for the autocomplete.
+// e.g. /facets/{property}?activityID=...&from=2023-01-01&prefix=th&limit=10
+func FacetsHandler(w http.ResponseWriter, r *http.Request) {
+	property, err := resolveProperty(mux.Vars(r)["property"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if property.ValueDataType != "string" && property.ValueDataType != "string array" {
+		http.Error(w, "Facets require a string or string array property.", http.StatusBadRequest)
+		return
+	}
+
+	query := r.URL.Query()
+	limit := int64(defaultFacetLimit)
+	if value := query.Get("limit"); value != "" {
+		if limit, err = strconv.ParseInt(value, 10, 64); err != nil || limit <= 0 {
+			http.Error(w, "Invalid limit.", http.StatusBadRequest)
+			return
+		}
+	}
+
+	// Optionally scoped to an activity and to a range of the occurredAt
+	filter, err := eventsFilter(r, bson.M{"propertyValues.key": property.ID})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if hex := query.Get("activityID"); hex != "" {
+		activityID, err := primitive.ObjectIDFromHex(hex)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		filter["activityID"] = activityID
+	}
+
+	valueFilter := bson.M{"$type": "string", "$ne": ""}
+	if prefix := query.Get("prefix"); prefix != "" {
+		valueFilter["$regex"] = primitive.Regex{Pattern: "^" + regexp.QuoteMeta(prefix), Options: "i"}
+	}
+
+	pipeline := []bson.M{
+		{"$match": filter},
+		{"$project": bson.M{"value": propertyValueExpression(property.ID)}},
+		// A string value is unwound as a single element array
+		{"$unwind": "$value"},
+		{"$match": bson.M{"value": valueFilter}},
+		// A value that is repeated in the array of an event is counted once
+		{"$group": bson.M{"_id": bson.M{"value": "$value", "event": "$_id"}}},
+		{"$group": bson.M{"_id": "$_id.value", "count": bson.M{"$sum": 1}}},
+		{"$sort": bson.D{{Key: "count", Value: -1}, {Key: "_id", Value: 1}}},
+		{"$limit": limit},
+	}
+
+	facets := []*Facet{}
+	if err := models.AggregateEvents(pipeline, &facets); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(FacetsResponse{PropertyID: property.ID.Hex(), Facets: facets})
+}
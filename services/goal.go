@@ -0,0 +1,485 @@
+package services
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/djamysh/PensieveAPI/models"
+	"github.com/djamysh/PensieveAPI/utils"
+)
+
+// Number of the previous periods in the progress history when it is not given
+const defaultGoalHistory = 7
+
+// Maximum number of the previous periods in the progress history, every period is a query
+const maxGoalHistory = 100
+
+// GoalRequest is the request body of the goal create and update endpoints,
+// pointers distinguish the not given fields from the zero values.
+type GoalRequest struct {
+	Name       *string  `json:"name"`
+	ActivityID *string  `json:"activityID"`
+	PropertyID *string  `json:"propertyID"`
+	Period     *string  `json:"period"`
+	Metric     *string  `json:"metric"`
+	Comparator *string  `json:"comparator"`
+	Target     *float64 `json:"target"`
+	Mode       *string  `json:"mode"`
+}
+
+type GoalPeriod struct {
+	From  time.Time `json:"from"`
+	To    time.Time `json:"to"`
+	Value float64   `json:"value"`
+	Met   bool      `json:"met"`
+}
+
+type GoalProgressResponse struct {
+	Goal     *models.Goal `json:"goal"`
+	Timezone string       `json:"timezone"`
+	Current  *GoalPeriod  `json:"current"`
+	// Difference between the target and the current value
+	Remaining   float64       `json:"remaining"`
+	History     []*GoalPeriod `json:"history"`
+	SuccessRate float64       `json:"successRate"`
+}
+
+// applyGoalRequest sets the given fields of the request on the goal and returns them as an update
+func applyGoalRequest(goal *models.Goal, request *GoalRequest) (bson.M, error) {
+	update := bson.M{}
+
+	if request.Name != nil {
+		goal.Name = *request.Name
+		update["name"] = goal.Name
+	}
+	if request.ActivityID != nil {
+		activityID, err := primitive.ObjectIDFromHex(*request.ActivityID)
+		if err != nil {
+			return nil, err
+		}
+		goal.ActivityID = activityID
+		update["activityID"] = goal.ActivityID
+	}
+	if request.PropertyID != nil {
+		// Empty string removes the property
+		goal.PropertyID = nil
+		if *request.PropertyID != "" {
+			property, err := resolveNumberProperty(*request.PropertyID)
+			if err != nil {
+				return nil, err
+			}
+			goal.PropertyID = &property.ID
+		}
+		update["propertyID"] = goal.PropertyID
+	}
+	if request.Period != nil {
+		goal.Period = utils.CleanInput(*request.Period)
+		update["period"] = goal.Period
+	}
+	if request.Metric != nil {
+		goal.Metric = utils.CleanInput(*request.Metric)
+		update["metric"] = goal.Metric
+	}
+	if request.Comparator != nil {
+		goal.Comparator = utils.CleanInput(*request.Comparator)
+		update["comparator"] = goal.Comparator
+	}
+	if request.Target != nil {
+		goal.Target = *request.Target
+		update["target"] = goal.Target
+	}
+	if request.Mode != nil {
+		goal.Mode = utils.CleanInput(*request.Mode)
+		update["mode"] = goal.Mode
+	}
+
+	// Default metric depends on the property
+	if goal.Metric == "" {
+		goal.Metric = models.GoalMetricCount
+		if goal.PropertyID != nil {
+			goal.Metric = models.GoalMetricSum
+		}
+		update["metric"] = goal.Metric
+	}
+
+	return update, validateGoal(goal)
+}
+
+func validateGoal(goal *models.Goal) error {
+	if _, err := models.GetActivity(goal.ActivityID); err != nil {
+		return errors.New("Goal activity is not found")
+	}
+	switch goal.Period {
+	case utils.BucketDay, utils.BucketWeek, utils.BucketMonth, utils.BucketYear:
+	default:
+		return errors.New("Invalid goal period")
+	}
+	switch goal.Metric {
+	case models.GoalMetricCount, models.GoalMetricDuration:
+	case models.GoalMetricSum:
+		if goal.PropertyID == nil {
+			return errors.New("Sum metric requires a property")
+		}
+	default:
+		return errors.New("Invalid goal metric")
+	}
+	if !utils.IsValidComparator(goal.Comparator) {
+		return errors.New("Invalid goal comparator")
+	}
+	switch goal.Mode {
+	case "", models.GoalModeSoft:
+	case models.GoalModeHard:
+		if !goal.IsLimit() {
+			return errors.New("Hard mode requires an upper bound comparator")
+		}
+	default:
+		return errors.New("Invalid goal mode")
+	}
+	return nil
+}
+
+// GoalPeriodValue computes the metric of the goal for the events in [from, to). The count and
+// sum goals take the events that occurred in the period, the duration goals take the part of
+// the intervals that overlaps with the period like the durations report.
+func GoalPeriodValue(goal *models.Goal, from, to time.Time) (float64, error) {
+	return goalPeriodValue(goal, from, to, primitive.NilObjectID)
+}
+
+// goalPeriodValue computes the metric of the goal without the event of the excludeID if it is given
+func goalPeriodValue(goal *models.Goal, from, to time.Time, excludeID primitive.ObjectID) (float64, error) {
+	filter := occurredAtFilter(bson.M{"activityID": goal.ActivityID}, from, to)
+	if goal.Metric == models.GoalMetricDuration {
+		// Touching intervals do not overlap with the period
+		filter = bson.M{
+			"activityID": goal.ActivityID,
+			"propertyValues": bson.M{
+				"$elemMatch": bson.M{
+					"key":         models.DefaultTimelingsPropertyID,
+					"value.start": bson.M{"$lt": to.Unix()},
+					"value.end":   bson.M{"$gt": from.Unix()},
+				},
+			},
+		}
+	}
+	if !excludeID.IsZero() {
+		filter["_id"] = bson.M{"$ne": excludeID}
+	}
+	events, err := models.GetEventsByFilter(filter)
+	if err != nil {
+		return 0, err
+	}
+
+	var value float64
+	for i := range events {
+		value += goalEventValue(goal, &events[i], from, to)
+	}
+	return value, nil
+}
+
+// sumGoals returns the sum goals of the property, they require the property to stay a number property
+func sumGoals(propertyID primitive.ObjectID) ([]models.Goal, error) {
+	return models.GetGoalsByFilter(bson.M{"propertyID": propertyID, "metric": models.GoalMetricSum})
+}
+
+// goalEventValue is the contribution of a single event to the metric of the goal in [from, to)
+func goalEventValue(goal *models.Goal, event *models.Event, from, to time.Time) float64 {
+	switch goal.Metric {
+	case models.GoalMetricCount:
+		return 1
+	case models.GoalMetricSum:
+		for _, pair := range event.PropertyValues {
+			if pair.Key == *goal.PropertyID {
+				if number, ok := utils.ToFloat64(pair.Value); ok {
+					return number
+				}
+			}
+		}
+	case models.GoalMetricDuration:
+		if start, end, ok := eventInterval(event); ok {
+			// Only the part of the interval in the period
+			if start < from.Unix() {
+				start = from.Unix()
+			}
+			if end > to.Unix() {
+				end = to.Unix()
+			}
+			if end > start {
+				return float64(end - start)
+			}
+		}
+	}
+	return 0
+}
+
+// eventGoalPeriods returns the starts of the periods of the goal that the event counts in,
+// the periods that the interval crosses for a duration goal, else the period it occurred in.
+func eventGoalPeriods(goal *models.Goal, event *models.Event, loc *time.Location) []time.Time {
+	if goal.Metric == models.GoalMetricDuration {
+		start, end, ok := eventInterval(event)
+		if !ok {
+			return nil
+		}
+		var periods []time.Time
+		for period := range splitInterval(time.Unix(start, 0), time.Unix(end, 0), goal.Period, loc) {
+			periods = append(periods, period)
+		}
+		sort.Slice(periods, func(i, j int) bool { return periods[i].Before(periods[j]) })
+		return periods
+	}
+	return []time.Time{utils.BucketStart(event.OccurredAt, goal.Period, loc)}
+}
+
+// checkLimits checks whether the event exceeds the limit goals of its activity in the
+// periods that the event counts in, the previous value of an updated event is excluded by
+// its ID. It returns the warnings of the soft limits, or an *utils.EventError if a hard
+// limit is exceeded.
+func checkLimits(event *models.Event, excludeID primitive.ObjectID, loc *time.Location) ([]string, error) {
+	goals, err := models.GetGoalsByFilter(bson.M{"activityID": event.ActivityID})
+	if err != nil {
+		return nil, err
+	}
+
+	var warnings []string
+	for i := range goals {
+		goal := &goals[i]
+		if !goal.IsLimit() {
+			continue
+		}
+
+		for _, from := range eventGoalPeriods(goal, event, loc) {
+			to := utils.NextBucket(from, goal.Period, loc)
+			value, err := goalPeriodValue(goal, from, to, excludeID)
+			if err != nil {
+				return nil, err
+			}
+			value += goalEventValue(goal, event, from, to)
+			if utils.Compare(value, goal.Comparator, goal.Target) {
+				continue
+			}
+
+			msg := fmt.Sprintf("Goal %q limit is exceeded : %v of %v per %s", goal.Name, value, goal.Target, goal.Period)
+			if goal.Mode == models.GoalModeHard {
+				return nil, &utils.EventError{Message: msg}
+			}
+			warnings = append(warnings, msg)
+			break
+		}
+	}
+	return warnings, nil
+}
+
+func goalPeriod(goal *models.Goal, from, to time.Time, loc *time.Location) (*GoalPeriod, error) {
+	value, err := GoalPeriodValue(goal, from, to)
+	if err != nil {
+		return nil, err
+	}
+	return &GoalPeriod{
+		From:  from.In(loc),
+		To:    to.In(loc),
+		Value: value,
+		Met:   utils.Compare(value, goal.Comparator, goal.Target),
+	}, nil
+}
+
+func CreateGoalHandler(w http.ResponseWriter, r *http.Request) {
+	var request GoalRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+
+	var goal models.Goal
+	if _, err := applyGoalRequest(&goal, &request); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := goal.CreateGoal(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Send a response indicating that the goal was created successfully
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(goal)
+}
+
+func UpdateGoalHandler(w http.ResponseWriter, r *http.Request) {
+	// Get the goal ID from the URL
+	vars := mux.Vars(r)
+	id, err := primitive.ObjectIDFromHex(vars["id"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var request GoalRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+
+	goal, err := models.GetGoal(id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	// Validation is done on the updated goal
+	update, err := applyGoalRequest(goal, &request)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	oldValue, err := models.UpdateGoal(id, update)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Send a response indicating that the goal was updated successfully
+	json.NewEncoder(w).Encode(oldValue)
+}
+
+func DeleteGoalHandler(w http.ResponseWriter, r *http.Request) {
+	// Get the goal ID from the URL
+	vars := mux.Vars(r)
+	id, err := primitive.ObjectIDFromHex(vars["id"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := models.DeleteGoal(id); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Send a response indicating that the goal was deleted successfully
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func GetGoalHandler(w http.ResponseWriter, r *http.Request) {
+	// Get the goal ID from the URL
+	vars := mux.Vars(r)
+	id, err := primitive.ObjectIDFromHex(vars["id"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	goal, err := models.GetGoal(id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	// Send the goal as a response
+	json.NewEncoder(w).Encode(goal)
+}
+
+func GetGoalsHandler(w http.ResponseWriter, r *http.Request) {
+	filter := bson.M{}
+
+	// Optionally only the goals of the given activity
+	if hex := r.URL.Query().Get("activityID"); hex != "" {
+		activityID, err := primitive.ObjectIDFromHex(hex)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		filter["activityID"] = activityID
+	}
+
+	goals, err := models.GetGoalsByFilter(filter)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Send the goals as a response
+	json.NewEncoder(w).Encode(goals)
+}
+
+// GoalProgressHandler computes the status of the current period of the goal
+// and the history of the previous periods in the request's timezone.
+// e.g. /goals/progress/{id}?periods=4
+func GoalProgressHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, err := primitive.ObjectIDFromHex(vars["id"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	loc, err := requestLocation(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	periods := defaultGoalHistory
+	if value := r.URL.Query().Get("periods"); value != "" {
+		if periods, err = strconv.Atoi(value); err != nil || periods < 0 {
+			http.Error(w, "Invalid periods.", http.StatusBadRequest)
+			return
+		}
+		if periods > maxGoalHistory {
+			http.Error(w, fmt.Sprintf("periods can be at most %d.", maxGoalHistory), http.StatusBadRequest)
+			return
+		}
+	}
+
+	goal, err := models.GetGoal(id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	response := GoalProgressResponse{
+		Goal:     goal,
+		Timezone: loc.String(),
+		History:  make([]*GoalPeriod, 0, periods),
+	}
+
+	from := utils.BucketStart(time.Now(), goal.Period, loc)
+	if response.Current, err = goalPeriod(goal, from, utils.NextBucket(from, goal.Period, loc), loc); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	response.Remaining = goal.Target - response.Current.Value
+
+	// Previous periods, the most recent first
+	metPeriods := 0
+	for i := 0; i < periods; i++ {
+		to := from
+		from = utils.BucketStart(to.Add(-time.Second), goal.Period, loc)
+
+		period, err := goalPeriod(goal, from, to, loc)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if period.Met {
+			metPeriods++
+		}
+		response.History = append(response.History, period)
+	}
+	if periods != 0 {
+		response.SuccessRate = float64(metPeriods) / float64(periods)
+	}
+
+	json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,104 @@
+package services
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/djamysh/PensieveAPI/models"
+	"github.com/djamysh/PensieveAPI/utils"
+)
+
+// Number of days of the heatmap when from is not given
+const defaultHeatmapDays = 365
+
+type HeatmapDay struct {
+	Date  string  `json:"date"`
+	Value float64 `json:"value"`
+}
+
+type HeatmapResponse struct {
+	ActivityID string        `json:"activityID"`
+	PropertyID string        `json:"propertyID,omitempty"`
+	Metric     string        `json:"metric"`
+	Timezone   string        `json:"timezone"`
+	From       string        `json:"from"`
+	To         string        `json:"to"`
+	Max        float64       `json:"max"`
+	Days       []*HeatmapDay `json:"days"`
+}
+
+// HeatmapHandler returns the per day counts, or the per day sums of the given number
+// property, of an activity for the date range, days without events are included.
+// e.g. /reports/heatmap/{activityID}?from=2023-01-01&to=2023-12-31&property=duration
+func HeatmapHandler(w http.ResponseWriter, r *http.Request) {
+	params, err := parseReportParams(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var property *models.Property
+	if value := r.URL.Query().Get("property"); value != "" {
+		if property, err = resolveNumberProperty(value); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	// Default range is the last year until today, to is exclusive
+	if params.To.IsZero() {
+		params.To = utils.NextBucket(utils.BucketStart(time.Now(), utils.BucketDay, params.Location), utils.BucketDay, params.Location)
+	}
+	if params.From.IsZero() {
+		to := params.To.In(params.Location)
+		params.From = time.Date(to.Year(), to.Month(), to.Day()-defaultHeatmapDays, 0, 0, 0, 0, params.Location)
+	}
+	if !params.From.Before(params.To) {
+		http.Error(w, "Invalid range, from must be before to.", http.StatusBadRequest)
+		return
+	}
+
+	first := utils.BucketStart(params.From, utils.BucketDay, params.Location)
+	last := utils.BucketStart(params.To.Add(-time.Second), utils.BucketDay, params.Location)
+	if err := checkDayRange(first, last); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	days, err := dailyValues(params, property)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	response := HeatmapResponse{
+		ActivityID: params.ActivityID.Hex(),
+		Metric:     MetricCount,
+		Timezone:   params.Location.String(),
+		From:       first.Format(utils.DateLayout),
+		To:         last.Format(utils.DateLayout),
+		Days:       []*HeatmapDay{},
+	}
+	if property != nil {
+		response.PropertyID = property.ID.Hex()
+		response.Metric = MetricSum
+	}
+
+	for day := first; !day.After(last); day = utils.NextBucket(day, utils.BucketDay, params.Location) {
+		heatmapDay := &HeatmapDay{Date: day.Format(utils.DateLayout)}
+		if value, isExist := days[day]; isExist {
+			heatmapDay.Value = float64(value.Count)
+			if property != nil {
+				heatmapDay.Value = value.Sum
+			}
+		}
+		// Sums may be negative, the max starts from the first day
+		if len(response.Days) == 0 || heatmapDay.Value > response.Max {
+			response.Max = heatmapDay.Value
+		}
+		response.Days = append(response.Days, heatmapDay)
+	}
+
+	json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,481 @@
+package services
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/djamysh/PensieveAPI/models"
+	"github.com/djamysh/PensieveAPI/utils"
+)
+
+// Number of the valid rows that are inserted at once
+const importBatchSize = 500
+
+// Maximum size of the uploaded CSV file that is kept in memory
+const maxImportMemory = 32 << 20
+
+// CSVImportMapping maps the columns of the CSV file to the properties of the activity,
+// the properties are given by their IDs or names. If no column is mapped, the columns
+// are mapped by their headers in the format of the CSV export.
+type CSVImportMapping struct {
+	// Column -> property, a timelings property column is a JSON object of timestamps
+	Columns map[string]string `json:"columns"`
+	// Column -> timeling of a timelings property, e.g. "Started": {"property": "timelings", "key": "start"}
+	Timelings map[string]TimelingColumn `json:"timelings"`
+	// Column of the occurredAt, optional
+	OccurredAt string `json:"occurredAt"`
+}
+
+type TimelingColumn struct {
+	Property string `json:"property"`
+	Key      string `json:"key"`
+}
+
+// ImportError is the error of a line of an imported file
+type ImportError struct {
+	// Line in the file, the header of a CSV file is the line 1
+	Line  int    `json:"line"`
+	Error string `json:"error"`
+}
+
+type CSVImportReport struct {
+	DryRun bool `json:"dryRun"`
+	Rows   int  `json:"rows"`
+	// Number of the inserted rows, the valid rows on a dry run
+	Imported int           `json:"imported"`
+	Failed   int           `json:"failed"`
+	Errors   []ImportError `json:"errors"`
+	// Soft limit and overlap warnings of the imported rows
+	Warnings []ImportError `json:"warnings,omitempty"`
+	// Error that stopped the import, the report covers the rows before it
+	Error string `json:"error,omitempty"`
+}
+
+// CSVImportError is an invalid CSV file or mapping, it rejects the whole import before any row
+type CSVImportError struct {
+	Message string
+}
+
+func (err *CSVImportError) Error() string {
+	return err.Message
+}
+
+func csvImportErrorf(format string, args ...interface{}) error {
+	return &CSVImportError{Message: fmt.Sprintf(format, args...)}
+}
+
+// importStatus is the status of the error that stopped an import
+func importStatus(err error) int {
+	if _, isImportErr := err.(*CSVImportError); isImportErr {
+		return http.StatusBadRequest
+	}
+	if isNotFound(err) {
+		return http.StatusNotFound
+	}
+	return http.StatusInternalServerError
+}
+
+// importColumn is a resolved column of the mapping
+type importColumn struct {
+	index    int
+	header   string
+	property *models.Property
+	// Timeling key of a timelings column, empty for the whole value
+	timelingKey string
+}
+
+// defaultImportMapping maps the headers that are in the format of the CSV export
+func defaultImportMapping(header []string, properties map[string]*models.Property) CSVImportMapping {
+	mapping := CSVImportMapping{Columns: map[string]string{}, Timelings: map[string]TimelingColumn{}}
+	for _, column := range header {
+		if column == CSVColumnOccurredAt {
+			mapping.OccurredAt = column
+			continue
+		}
+		if _, isExist := properties[column]; isExist {
+			mapping.Columns[column] = column
+			continue
+		}
+		if idx := strings.LastIndex(column, "."); idx != -1 {
+			if property, isExist := properties[column[:idx]]; isExist && property.ValueDataType == "timelings" {
+				mapping.Timelings[column] = TimelingColumn{Property: property.Name, Key: column[idx+1:]}
+			}
+		}
+	}
+	return mapping
+}
+
+// resolveImportColumns resolves the mapped columns to the defined properties of the activity
+func resolveImportColumns(activity *models.Activity, header []string, mapping CSVImportMapping) ([]importColumn, int, error) {
+	properties, err := models.GetPropertiesByFilter(bson.M{"_id": bson.M{"$in": activity.DefinedProperties}})
+	if err != nil {
+		return nil, 0, err
+	}
+	byName := make(map[string]*models.Property)
+	byID := make(map[string]*models.Property)
+	for i := range properties {
+		byName[properties[i].Name] = &properties[i]
+		byID[properties[i].ID.Hex()] = &properties[i]
+	}
+
+	if len(mapping.Columns) == 0 && len(mapping.Timelings) == 0 && mapping.OccurredAt == "" {
+		mapping = defaultImportMapping(header, byName)
+	}
+
+	indexes := make(map[string]int)
+	for i, column := range header {
+		indexes[column] = i
+	}
+
+	resolve := func(column string, target string) (int, *models.Property, error) {
+		index, isExist := indexes[column]
+		if !isExist {
+			return 0, nil, csvImportErrorf("Column %q is not in the file", column)
+		}
+		property, isExist := byID[target]
+		if !isExist {
+			property, isExist = byName[target]
+		}
+		if !isExist {
+			return 0, nil, csvImportErrorf("Property %q of the column %q is not defined on the activity", target, column)
+		}
+		if property.Formula != "" {
+			return 0, nil, csvImportErrorf("Column %q: %s", column, ComputedValueErr)
+		}
+		return index, property, nil
+	}
+
+	var columns []importColumn
+	for column, target := range mapping.Columns {
+		index, property, err := resolve(column, target)
+		if err != nil {
+			return nil, 0, err
+		}
+		columns = append(columns, importColumn{index: index, header: column, property: property})
+	}
+	for column, timeling := range mapping.Timelings {
+		index, property, err := resolve(column, timeling.Property)
+		if err != nil {
+			return nil, 0, err
+		}
+		if property.ValueDataType != "timelings" || timeling.Key == "" {
+			return nil, 0, csvImportErrorf("Column %q must be mapped to a key of a timelings property", column)
+		}
+		columns = append(columns, importColumn{index: index, header: column, property: property, timelingKey: timeling.Key})
+	}
+
+	occurredAtIndex := -1
+	if mapping.OccurredAt != "" {
+		index, isExist := indexes[mapping.OccurredAt]
+		if !isExist {
+			return nil, 0, csvImportErrorf("Column %q is not in the file", mapping.OccurredAt)
+		}
+		occurredAtIndex = index
+	}
+
+	if len(columns) == 0 && occurredAtIndex == -1 {
+		return nil, 0, csvImportErrorf("No column is mapped")
+	}
+	return columns, occurredAtIndex, nil
+}
+
+// parseArrayCell parses a JSON array, or a list separated by semicolons
+func parseArrayCell(cell string) ([]interface{}, error) {
+	var array []interface{}
+	if strings.HasPrefix(cell, "[") {
+		if err := json.Unmarshal([]byte(cell), &array); err != nil {
+			return nil, err
+		}
+		return array, nil
+	}
+	for _, element := range strings.Split(cell, ";") {
+		array = append(array, strings.TrimSpace(element))
+	}
+	return array, nil
+}
+
+// parseImportCell converts the cell into the value that the JSON decoder would give for the property
+func parseImportCell(column importColumn, cell string, loc *time.Location) (interface{}, error) {
+	switch column.property.ValueDataType {
+	case "string":
+		return cell, nil
+	case "number":
+		return strconv.ParseFloat(strings.TrimSpace(cell), 64)
+	case "string array":
+		return parseArrayCell(cell)
+	case "number array":
+		elements, err := parseArrayCell(cell)
+		if err != nil {
+			return nil, err
+		}
+		for i, element := range elements {
+			if str, ok := element.(string); ok {
+				if elements[i], err = strconv.ParseFloat(str, 64); err != nil {
+					return nil, err
+				}
+			}
+		}
+		return elements, nil
+	case "timelings":
+		if column.timelingKey == "" {
+			var timelings map[string]interface{}
+			if err := json.Unmarshal([]byte(cell), &timelings); err != nil {
+				return nil, err
+			}
+			return timelings, nil
+		}
+		timestamp, err := utils.ParseTime(strings.TrimSpace(cell), loc, false)
+		if err != nil {
+			return nil, err
+		}
+		return float64(timestamp.Unix()), nil
+	}
+	return nil, TypeErr
+}
+
+// importRow converts the row into an event request and validates it like the created events
+func importRow(activity *models.Activity, columns []importColumn, occurredAtIndex int, record []string, loc *time.Location) (*models.Event, error) {
+	request := CreateEventRequest{ActivityID: activity.ID.Hex(), PropertyValues: map[string]interface{}{}}
+
+	for _, column := range columns {
+		cell := record[column.index]
+		// Empty cells are not given, they get the default values
+		if strings.TrimSpace(cell) == "" {
+			continue
+		}
+		value, err := parseImportCell(column, cell, loc)
+		if err != nil {
+			return nil, fmt.Errorf("Column %q: %v", column.header, err)
+		}
+
+		key := column.property.ID.Hex()
+		if column.timelingKey == "" {
+			request.PropertyValues[key] = value
+			continue
+		}
+		timelings, isExist := request.PropertyValues[key].(map[string]interface{})
+		if !isExist {
+			timelings = map[string]interface{}{}
+			request.PropertyValues[key] = timelings
+		}
+		timelings[column.timelingKey] = value
+	}
+
+	if occurredAtIndex != -1 && strings.TrimSpace(record[occurredAtIndex]) != "" {
+		occurredAt, err := utils.ParseTime(strings.TrimSpace(record[occurredAtIndex]), loc, false)
+		if err != nil {
+			return nil, fmt.Errorf("Column %q: %v", CSVColumnOccurredAt, err)
+		}
+		request.OccurredAt = &occurredAt
+	}
+
+	return ControlEvent(&request, nil)
+}
+
+// hasEventRules reports whether the events of the activity are checked against the
+// other events, i.e. an overlap policy or a limit goal.
+func hasEventRules(activity *models.Activity) (bool, error) {
+	if activity.OverlapPolicy != "" && activity.OverlapPolicy != models.OverlapAllow {
+		return true, nil
+	}
+	goals, err := models.GetGoalsByFilter(bson.M{"activityID": activity.ID})
+	if err != nil {
+		return false, err
+	}
+	for i := range goals {
+		if goals[i].IsLimit() {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// ImportCSV validates the rows of the CSV file as the events of the activity and inserts the
+// valid ones in batches, nothing is inserted on a dry run. The rows are checked against the
+// overlap policy and the limit goals of the activity like the created events, such rows are
+// inserted one by one so every row is checked against the previous ones. A dry run only
+// checks them against the existing events. The returned error is about the whole import,
+// e.g. an invalid mapping as a *CSVImportError, the errors of the rows are in the report. If a
+// batch fails to be inserted the report of the rows so far is returned with the error.
+func ImportCSV(activityID primitive.ObjectID, file io.Reader, mapping CSVImportMapping, loc *time.Location, dryRun bool) (*CSVImportReport, error) {
+	activity, err := models.GetActivity(activityID)
+	if err != nil {
+		return nil, err
+	}
+
+	reader := csv.NewReader(file)
+	reader.FieldsPerRecord = -1
+	header, err := reader.Read()
+	if err != nil {
+		return nil, csvImportErrorf("Invalid CSV header: %v", err)
+	}
+
+	columns, occurredAtIndex, err := resolveImportColumns(activity, header, mapping)
+	if err != nil {
+		return nil, err
+	}
+
+	checked, err := hasEventRules(activity)
+	if err != nil {
+		return nil, err
+	}
+	batchSize := importBatchSize
+	if checked {
+		batchSize = 1
+	}
+
+	report := &CSVImportReport{DryRun: dryRun, Errors: []ImportError{}}
+	var batch []*models.Event
+	flush := func() error {
+		if !dryRun {
+			if err := models.InsertEvents(batch); err != nil {
+				return err
+			}
+		}
+		report.Imported += len(batch)
+		batch = batch[:0]
+		return nil
+	}
+
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+
+		report.Rows++
+		if err != nil {
+			parseErr, isParseErr := err.(*csv.ParseError)
+			if !isParseErr {
+				return nil, err
+			}
+			report.Failed++
+			report.Errors = append(report.Errors, ImportError{Line: parseErr.StartLine, Error: parseErr.Err.Error()})
+			continue
+		}
+
+		line, _ := reader.FieldPos(0)
+		if len(record) != len(header) {
+			report.Failed++
+			report.Errors = append(report.Errors, ImportError{Line: line, Error: fmt.Sprintf("Expected %d columns, got %d", len(header), len(record))})
+			continue
+		}
+
+		event, err := importRow(activity, columns, occurredAtIndex, record, loc)
+		if err != nil {
+			report.Failed++
+			report.Errors = append(report.Errors, ImportError{Line: line, Error: err.Error()})
+			continue
+		}
+
+		// The running timers are checked and inserted one by one like the rows of the checked activities
+		isRunningTimer := models.IsRunningTimer(event.PropertyValues)
+		if checked || isRunningTimer {
+			warnings, err := checkEventRules(event, primitive.NilObjectID, loc)
+			if err != nil {
+				if _, isEventErr := err.(*utils.EventError); !isEventErr {
+					return report, err
+				}
+				report.Failed++
+				report.Errors = append(report.Errors, ImportError{Line: line, Error: err.Error()})
+				continue
+			}
+			for _, warning := range warnings {
+				report.Warnings = append(report.Warnings, ImportError{Line: line, Error: warning})
+			}
+		}
+
+		if batch = append(batch, event); len(batch) == batchSize || isRunningTimer {
+			if err := flush(); err != nil {
+				return report, err
+			}
+		}
+	}
+
+	if err := flush(); err != nil {
+		return report, err
+	}
+	return report, nil
+}
+
+// ImportCSVHandler imports the events of the activity from a CSV file. The file and the
+// JSON mapping are given as the "file" and "mapping" fields of a multipart form, or the
+// file is the request body and the mapping is the mapping query parameter.
+// e.g. /import/csv/{activityID}?dryRun=true&tz=Europe/Istanbul
+func ImportCSVHandler(w http.ResponseWriter, r *http.Request) {
+	activityID, err := primitive.ObjectIDFromHex(mux.Vars(r)["activityID"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	loc, err := requestLocation(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	query := r.URL.Query()
+	dryRun := false
+	if value := query.Get("dryRun"); value != "" {
+		if dryRun, err = strconv.ParseBool(value); err != nil {
+			http.Error(w, "Invalid dryRun.", http.StatusBadRequest)
+			return
+		}
+	}
+
+	var file io.Reader = r.Body
+	mappingJSON := query.Get("mapping")
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		if err := r.ParseMultipartForm(maxImportMemory); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		formFile, _, err := r.FormFile("file")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		defer formFile.Close()
+		file = formFile
+		if value := r.FormValue("mapping"); value != "" {
+			mappingJSON = value
+		}
+	}
+
+	var mapping CSVImportMapping
+	if mappingJSON != "" {
+		if err := json.Unmarshal([]byte(mappingJSON), &mapping); err != nil {
+			http.Error(w, "Invalid mapping: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	if _, err := models.GetActivity(activityID); err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	report, err := ImportCSV(activityID, file, mapping, loc, dryRun)
+	if err != nil && report == nil {
+		http.Error(w, err.Error(), importStatus(err))
+		return
+	}
+	if err != nil {
+		// The rows before the error may be inserted, the report tells which ones
+		report.Error = err.Error()
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(importStatus(err))
+	}
+	json.NewEncoder(w).Encode(report)
+}
@@ -0,0 +1,174 @@
+package services
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/djamysh/PensieveAPI/models"
+	"github.com/djamysh/PensieveAPI/utils"
+)
+
+// Timeling keys that have a meaning, the other keys are free tags
+const (
+	TimelingInstant = "instant"
+	TimelingStart   = "start"
+	TimelingEnd     = "end"
+)
+
+var IntervalErr = &utils.EventError{Message: "Invalid interval, end must not be before start"}
+
+// ParseTimelings converts the given timelings value into map[string]int64
+// and validates the interval semantics of it.
+func ParseTimelings(value interface{}) (map[string]int64, error) {
+	timelings, ok := utils.ToTimelings(value)
+	if !ok {
+		return nil, TimestampErr
+	}
+
+	start, hasStart := timelings[TimelingStart]
+	end, hasEnd := timelings[TimelingEnd]
+	if hasStart && hasEnd && end < start {
+		return nil, IntervalErr
+	}
+	return timelings, nil
+}
+
+// timelingsInterval returns the start and end of the given timelings, ok is false
+// if the timelings is not a closed interval.
+func timelingsInterval(value interface{}) (start, end int64, ok bool) {
+	timelings, isTimelings := utils.ToTimelings(value)
+	if !isTimelings {
+		return 0, 0, false
+	}
+
+	start, hasStart := timelings[TimelingStart]
+	end, hasEnd := timelings[TimelingEnd]
+	return start, end, hasStart && hasEnd
+}
+
+// eventInterval returns the interval of the default timelings of the event
+func eventInterval(event *models.Event) (start, end int64, ok bool) {
+	for _, pair := range event.PropertyValues {
+		if pair.Key == models.DefaultTimelingsPropertyID {
+			return timelingsInterval(pair.Value)
+		}
+	}
+	return 0, 0, false
+}
+
+// eventDurations returns the durations in seconds of the interval timelings
+// of the event, keyed by property ID.
+func eventDurations(event *models.Event) map[string]int64 {
+	var durations map[string]int64
+	for _, pair := range event.PropertyValues {
+		if start, end, ok := timelingsInterval(pair.Value); ok {
+			if durations == nil {
+				durations = make(map[string]int64)
+			}
+			durations[pair.Key.Hex()] = end - start
+		}
+	}
+	return durations
+}
+
+// intervalFilter matches the events whose default timelings interval intersects with [start, end]
+func intervalFilter(start, end int64) bson.M {
+	return bson.M{
+		"propertyValues": bson.M{
+			"$elemMatch": bson.M{
+				"key":         models.DefaultTimelingsPropertyID,
+				"value.start": bson.M{"$lte": end},
+				"value.end":   bson.M{"$gte": start},
+			},
+		},
+	}
+}
+
+// checkOverlap applies the overlap policy of the event's activity, if the event's
+// interval overlaps with another event of the same activity it returns a warning
+// or an *utils.EventError depending on the policy.
+func checkOverlap(event *models.Event, excludeID primitive.ObjectID) ([]string, error) {
+	start, end, ok := eventInterval(event)
+	if !ok {
+		return nil, nil
+	}
+
+	activity, err := models.GetActivity(event.ActivityID)
+	if err != nil {
+		return nil, err
+	}
+	if activity.OverlapPolicy == "" || activity.OverlapPolicy == models.OverlapAllow {
+		return nil, nil
+	}
+
+	// Touching intervals, e.g. one ends when the other starts, are not overlapping
+	filter := bson.M{
+		"activityID": event.ActivityID,
+		"propertyValues": bson.M{
+			"$elemMatch": bson.M{
+				"key":         models.DefaultTimelingsPropertyID,
+				"value.start": bson.M{"$lt": end},
+				"value.end":   bson.M{"$gt": start},
+			},
+		},
+	}
+	if !excludeID.IsZero() {
+		filter["_id"] = bson.M{"$ne": excludeID}
+	}
+
+	overlappingEvents, err := models.GetEventsByFilter(filter)
+	if err != nil {
+		return nil, err
+	}
+	if len(overlappingEvents) == 0 {
+		return nil, nil
+	}
+
+	ids := make([]string, 0, len(overlappingEvents))
+	for _, overlappingEvent := range overlappingEvents {
+		ids = append(ids, overlappingEvent.ID.Hex())
+	}
+	msg := fmt.Sprintf("Interval overlaps with the events of the same activity : %s", strings.Join(ids, ", "))
+
+	if activity.OverlapPolicy == models.OverlapReject {
+		return nil, &utils.EventError{Message: msg}
+	}
+	return []string{msg}, nil
+}
+
+// GetEventsAtHandler answers what was I doing at time T, it returns the
+// events whose default timelings interval contains the given UNIX timestamp.
+func GetEventsAtHandler(w http.ResponseWriter, r *http.Request) {
+	expander, err := newExpander(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	vars := mux.Vars(r)
+	timestamp, err := strconv.ParseInt(vars["timestamp"], 10, 64)
+	if err != nil {
+		http.Error(w, TimestampErr.Error(), http.StatusBadRequest)
+		return
+	}
+
+	events, err := models.GetEventsByFilter(intervalFilter(timestamp, timestamp))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	responses, err := expander.Events(events)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(responses)
+}
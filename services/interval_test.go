@@ -0,0 +1,81 @@
+package services
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestParseTimelings(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   interface{}
+		want    map[string]int64
+		wantErr error
+	}{
+		{"instant", map[string]interface{}{TimelingInstant: float64(100)}, map[string]int64{TimelingInstant: 100}, nil},
+		{"interval", map[string]interface{}{TimelingStart: float64(100), TimelingEnd: float64(200)}, map[string]int64{TimelingStart: 100, TimelingEnd: 200}, nil},
+		{"empty interval", map[string]interface{}{TimelingStart: float64(100), TimelingEnd: float64(100)}, map[string]int64{TimelingStart: 100, TimelingEnd: 100}, nil},
+		{"running timer", primitive.M{TimelingStart: int64(100)}, map[string]int64{TimelingStart: 100}, nil},
+		{"free tags", map[string]interface{}{"wakeUp": float64(50), TimelingEnd: float64(10)}, map[string]int64{"wakeUp": 50, TimelingEnd: 10}, nil},
+		{"end before start", map[string]interface{}{TimelingStart: float64(200), TimelingEnd: float64(100)}, nil, IntervalErr},
+		{"fractional timestamp", map[string]interface{}{TimelingInstant: 1.5}, nil, TimestampErr},
+		{"not a map", float64(100), nil, TimestampErr},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := ParseTimelings(test.value)
+			if err != test.wantErr {
+				t.Fatalf("ParseTimelings(%v) returned the error %v, want %v", test.value, err, test.wantErr)
+			}
+			if err == nil && !reflect.DeepEqual(got, test.want) {
+				t.Errorf("ParseTimelings(%v) = %v, want %v", test.value, got, test.want)
+			}
+		})
+	}
+}
+
+func TestTimelingsInterval(t *testing.T) {
+	tests := []struct {
+		name               string
+		value              interface{}
+		wantStart, wantEnd int64
+		wantOK             bool
+	}{
+		{"interval", map[string]int64{TimelingStart: 10, TimelingEnd: 20}, 10, 20, true},
+		{"running timer", map[string]int64{TimelingStart: 10}, 0, 0, false},
+		{"instant", map[string]int64{TimelingInstant: 10}, 0, 0, false},
+		{"not timelings", "10", 0, 0, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			start, end, ok := timelingsInterval(test.value)
+			if ok != test.wantOK || (ok && (start != test.wantStart || end != test.wantEnd)) {
+				t.Errorf("timelingsInterval(%v) = %d, %d, %v, want %d, %d, %v", test.value, start, end, ok, test.wantStart, test.wantEnd, test.wantOK)
+			}
+		})
+	}
+}
+
+func TestIsGeneratedTimelings(t *testing.T) {
+	submittedAt := time.Unix(100, 0)
+	tests := []struct {
+		name  string
+		value interface{}
+		want  bool
+	}{
+		{"generated instant", primitive.M{TimelingInstant: int64(100)}, true},
+		{"other instant", map[string]int64{TimelingInstant: 50}, false},
+		{"interval", map[string]int64{TimelingStart: 100, TimelingEnd: 200}, false},
+		{"instant with interval", map[string]int64{TimelingInstant: 100, TimelingStart: 100}, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := isGeneratedTimelings(test.value, submittedAt); got != test.want {
+				t.Errorf("isGeneratedTimelings(%v) = %v, want %v", test.value, got, test.want)
+			}
+		})
+	}
+}
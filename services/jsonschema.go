@@ -0,0 +1,126 @@
+package services
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/djamysh/PensieveAPI/models"
+)
+
+// JSON Schema of the event payloads of the activities, it is generated from the
+// current defined properties on every request so it follows the property changes.
+
+const JSONSchemaDialect = "https://json-schema.org/draft/2020-12/schema"
+
+// propertyJSONSchema returns the schema of the value of the property. Computed values are set
+// by the server and giving them is rejected, so their schema is the false schema.
+func propertyJSONSchema(property *models.Property) interface{} {
+	if property.Formula != "" {
+		return false
+	}
+
+	schema := map[string]interface{}{"title": property.Name}
+	if property.Description != "" {
+		schema["description"] = property.Description
+	}
+
+	switch property.ValueDataType {
+	case "string":
+		schema["type"] = "string"
+	case "number":
+		schema["type"] = "number"
+	case "string array":
+		schema["type"] = "array"
+		schema["items"] = map[string]interface{}{"type": "string"}
+	case "number array":
+		schema["type"] = "array"
+		schema["items"] = map[string]interface{}{"type": "number"}
+	case "timelings":
+		// UNIX timestamps in seconds, the other keys are free tags
+		timestamp := func(description string) map[string]interface{} {
+			return map[string]interface{}{"type": "integer", "description": description}
+		}
+		schema["type"] = "object"
+		schema["properties"] = map[string]interface{}{
+			TimelingInstant: timestamp("Moment of an instant event"),
+			TimelingStart:   timestamp("Start of an interval, not after the end"),
+			TimelingEnd:     timestamp("End of an interval, not before the start"),
+		}
+		schema["additionalProperties"] = map[string]interface{}{"type": "integer"}
+	}
+
+	return schema
+}
+
+// ActivityJSONSchema returns the JSON Schema of the event creation payload of the activity.
+// The property values are keyed by the property IDs, every property value is optional.
+func ActivityJSONSchema(activity *models.Activity) (map[string]interface{}, error) {
+	properties, err := models.GetPropertiesByFilter(bson.M{"_id": bson.M{"$in": activity.DefinedProperties}})
+	if err != nil {
+		return nil, err
+	}
+	propertiesMap := make(map[primitive.ObjectID]*models.Property)
+	for i := range properties {
+		propertiesMap[properties[i].ID] = &properties[i]
+	}
+
+	propertyValues := make(map[string]interface{})
+	for _, id := range activity.DefinedProperties {
+		if property, isExist := propertiesMap[id]; isExist {
+			propertyValues[id.Hex()] = propertyJSONSchema(property)
+		}
+	}
+
+	schema := map[string]interface{}{
+		"$schema": JSONSchemaDialect,
+		"title":   activity.Name,
+		"type":    "object",
+		"properties": map[string]interface{}{
+			"activityID": map[string]interface{}{"const": activity.ID.Hex()},
+			"occurredAt": map[string]interface{}{
+				"type":        "string",
+				"format":      "date-time",
+				"description": "Moment that the event happened, defaults to the submission time",
+			},
+			"propertyValues": map[string]interface{}{
+				"type":                 "object",
+				"properties":           propertyValues,
+				"additionalProperties": false,
+			},
+		},
+		"required":             []string{"activityID", "propertyValues"},
+		"additionalProperties": false,
+	}
+	if activity.Description != "" {
+		schema["description"] = activity.Description
+	}
+	return schema, nil
+}
+
+// ActivityJSONSchemaHandler returns the JSON Schema of the event payload of the activity
+// e.g. /schema/events/{activityID}
+func ActivityJSONSchemaHandler(w http.ResponseWriter, r *http.Request) {
+	activityID, err := primitive.ObjectIDFromHex(mux.Vars(r)["activityID"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	activity, err := models.GetActivity(activityID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	schema, err := ActivityJSONSchema(activity)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/schema+json")
+	json.NewEncoder(w).Encode(schema)
+}
@@ -0,0 +1,51 @@
+package services
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/djamysh/PensieveAPI/models"
+)
+
+func TestPropertyJSONSchema(t *testing.T) {
+	integer := func(description string) map[string]interface{} {
+		return map[string]interface{}{"type": "integer", "description": description}
+	}
+
+	tests := []struct {
+		name     string
+		property models.Property
+		want     interface{}
+	}{
+		{"string", models.Property{Name: "note", Description: "Free text", ValueDataType: "string"}, map[string]interface{}{
+			"title": "note", "description": "Free text", "type": "string",
+		}},
+		{"number", models.Property{Name: "distance", ValueDataType: "number"}, map[string]interface{}{
+			"title": "distance", "type": "number",
+		}},
+		{"string array", models.Property{Name: "tags", ValueDataType: "string array"}, map[string]interface{}{
+			"title": "tags", "type": "array", "items": map[string]interface{}{"type": "string"},
+		}},
+		{"number array", models.Property{Name: "laps", ValueDataType: "number array"}, map[string]interface{}{
+			"title": "laps", "type": "array", "items": map[string]interface{}{"type": "number"},
+		}},
+		{"timelings", models.Property{Name: "timelings", ValueDataType: "timelings"}, map[string]interface{}{
+			"title": "timelings",
+			"type":  "object",
+			"properties": map[string]interface{}{
+				TimelingInstant: integer("Moment of an instant event"),
+				TimelingStart:   integer("Start of an interval, not after the end"),
+				TimelingEnd:     integer("End of an interval, not before the start"),
+			},
+			"additionalProperties": map[string]interface{}{"type": "integer"},
+		}},
+		{"computed", models.Property{Name: "pace", ValueDataType: "number", Formula: "distance / duration(timelings)"}, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := propertyJSONSchema(&test.property); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("propertyJSONSchema() = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
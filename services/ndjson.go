@@ -0,0 +1,511 @@
+package services
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+
+	"github.com/djamysh/PensieveAPI/models"
+	"github.com/djamysh/PensieveAPI/utils"
+)
+
+// Newline delimited JSON dump of the dataset, every line is a record of a property,
+// an activity or an event. The properties come first and the events last, so the
+// records only reference the records that are above them.
+
+const (
+	RecordProperty = "property"
+	RecordActivity = "activity"
+	RecordEvent    = "event"
+)
+
+type NDJSONRecord struct {
+	Type string          `json:"type"`
+	Data json.RawMessage `json:"data"`
+}
+
+type ImportCounts struct {
+	Created int `json:"created"`
+	// Matched records are mapped to the existing records with the same ID or name
+	Matched int `json:"matched"`
+	// Skipped events already exist with the same ID
+	Skipped int `json:"skipped"`
+}
+
+type NDJSONImportReport struct {
+	DryRun     bool          `json:"dryRun"`
+	Properties ImportCounts  `json:"properties"`
+	Activities ImportCounts  `json:"activities"`
+	Events     ImportCounts  `json:"events"`
+	Errors     []ImportError `json:"errors"`
+}
+
+// ExportNDJSONHandler streams the properties, the activities and the events as NDJSON,
+// optionally only an activity with its properties and events in a range.
+// e.g. /export/ndjson?activityID=...&from=2023-01-01
+func ExportNDJSONHandler(w http.ResponseWriter, r *http.Request) {
+	eventFilter, err := eventsFilter(r, bson.M{})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	activitiesFilter := bson.M{}
+	propertiesFilter := bson.M{}
+
+	if hex := r.URL.Query().Get("activityID"); hex != "" {
+		activityID, err := primitive.ObjectIDFromHex(hex)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		activity, err := models.GetActivity(activityID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		eventFilter["activityID"] = activityID
+		activitiesFilter["_id"] = activityID
+		propertiesFilter["_id"] = bson.M{"$in": activity.DefinedProperties}
+	}
+
+	properties, err := models.GetPropertiesByFilter(propertiesFilter)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	// Computed properties come after the properties that their formulas reference
+	sort.SliceStable(properties, func(i, j int) bool {
+		return properties[i].Formula == "" && properties[j].Formula != ""
+	})
+
+	activities, err := models.GetActivitiesByFilter(activitiesFilter)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	// Encode writes a newline after every value
+	encoder := json.NewEncoder(w)
+	write := func(recordType string, data interface{}) error {
+		return encoder.Encode(struct {
+			Type string      `json:"type"`
+			Data interface{} `json:"data"`
+		}{recordType, data})
+	}
+
+	for i := range properties {
+		if err := write(RecordProperty, &properties[i]); err != nil {
+			return
+		}
+	}
+	for i := range activities {
+		if err := write(RecordActivity, &activities[i]); err != nil {
+			return
+		}
+	}
+
+	// The status is already sent, an error while streaming can only cut the response
+	flusher, _ := w.(http.Flusher)
+	count := 0
+	err = models.StreamEvents(eventFilter, func(event *models.Event) error {
+		if count++; count%500 == 0 && flusher != nil {
+			flusher.Flush()
+		}
+		return write(RecordEvent, event)
+	})
+	if err != nil {
+		log.Println("NDJSON export is interrupted:", err)
+	}
+}
+
+// ndjsonImporter maps the IDs of the imported records to the IDs of the records in this instance
+type ndjsonImporter struct {
+	dryRun bool
+	report *NDJSONImportReport
+	// Imported ID -> property or activity in this instance
+	properties map[primitive.ObjectID]*models.Property
+	activities map[primitive.ObjectID]*models.Activity
+	// ID in this instance -> property, to fill and compute the values of the events
+	localProperties map[primitive.ObjectID]*models.Property
+	// Events that wait to be inserted and their lines
+	batch      []*models.Event
+	batchLines []int
+}
+
+func isNotFound(err error) bool {
+	return err == mongo.ErrNoDocuments
+}
+
+// property returns the property of this instance that the imported property ID is mapped to
+func (importer *ndjsonImporter) property(id primitive.ObjectID) (*models.Property, error) {
+	if property, isExist := importer.properties[id]; isExist {
+		return property, nil
+	}
+	property, err := importer.localProperty(id)
+	if err != nil {
+		return nil, err
+	}
+	importer.properties[id] = property
+	return property, nil
+}
+
+// localProperty returns the property with the ID in this instance
+func (importer *ndjsonImporter) localProperty(id primitive.ObjectID) (*models.Property, error) {
+	if property, isExist := importer.localProperties[id]; isExist {
+		return property, nil
+	}
+	property, err := models.GetProperty(id)
+	if isNotFound(err) {
+		return nil, fmt.Errorf("Unknown property %s", id.Hex())
+	} else if err != nil {
+		return nil, err
+	}
+	importer.localProperties[id] = property
+	return property, nil
+}
+
+// activity returns the activity of this instance that the imported activity ID is mapped to
+func (importer *ndjsonImporter) activity(id primitive.ObjectID) (*models.Activity, error) {
+	if activity, isExist := importer.activities[id]; isExist {
+		return activity, nil
+	}
+	activity, err := models.GetActivity(id)
+	if isNotFound(err) {
+		return nil, fmt.Errorf("Unknown activity %s", id.Hex())
+	} else if err != nil {
+		return nil, err
+	}
+	importer.activities[id] = activity
+	return activity, nil
+}
+
+// importProperty maps the property to the property with the same ID or name, or creates it with its ID
+func (importer *ndjsonImporter) importProperty(property models.Property) error {
+	counts := &importer.report.Properties
+
+	local, err := models.GetProperty(property.ID)
+	if isNotFound(err) {
+		local, err = models.GetPropertyByName(property.Name)
+	}
+	if err == nil {
+		if local.ValueDataType != property.ValueDataType {
+			return fmt.Errorf("Property %q is a %s property, not %s", local.Name, local.ValueDataType, property.ValueDataType)
+		}
+		importer.properties[property.ID] = local
+		importer.localProperties[local.ID] = local
+		counts.Matched++
+		return nil
+	} else if !isNotFound(err) {
+		return err
+	}
+
+	// Only the server defines the built-in properties
+	property.System = false
+	property.ValueDataType = utils.CleanInput(property.ValueDataType)
+	if property.Formula != "" {
+		// The referenced properties are not inserted on a dry run
+		if importer.dryRun {
+			_, err = utils.ParseFormula(property.Formula)
+		} else {
+			err = validateFormula(&property)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if !property.IsValidType() {
+		return fmt.Errorf("Invalid data type %q", property.ValueDataType)
+	}
+
+	if !importer.dryRun {
+		if err := property.ImportProperty(); err != nil {
+			return err
+		}
+	}
+	importer.properties[property.ID] = &property
+	importer.localProperties[property.ID] = &property
+	counts.Created++
+	return nil
+}
+
+// importActivity maps the activity to the activity with the same ID or name, or creates it with its ID.
+// The properties that a matched activity does not define are added to it with the cascade to its events.
+func (importer *ndjsonImporter) importActivity(activity models.Activity) error {
+	counts := &importer.report.Activities
+
+	definedProperties := make([]primitive.ObjectID, 0, len(activity.DefinedProperties))
+	for _, id := range activity.DefinedProperties {
+		property, err := importer.property(id)
+		if err != nil {
+			return err
+		}
+		definedProperties = append(definedProperties, property.ID)
+	}
+
+	local, err := models.GetActivity(activity.ID)
+	if isNotFound(err) {
+		local, err = models.GetActivityByName(activity.Name)
+	}
+	if err == nil {
+		merged := local.DefinedProperties
+		defined := make(map[primitive.ObjectID]bool)
+		for _, id := range local.DefinedProperties {
+			defined[id] = true
+		}
+		for _, id := range definedProperties {
+			if !defined[id] {
+				merged = append(merged, id)
+			}
+		}
+
+		if len(merged) != len(local.DefinedProperties) && !importer.dryRun {
+			if err := UpdateActivityEventRelations(local.ID, merged); err != nil {
+				return err
+			}
+			if _, err := models.UpdateActivity(local.ID, bson.M{"definedProperties": merged}); err != nil {
+				return err
+			}
+		}
+		local.DefinedProperties = merged
+		importer.activities[activity.ID] = local
+		counts.Matched++
+		return nil
+	} else if !isNotFound(err) {
+		return err
+	}
+
+	activity.OverlapPolicy = utils.CleanInput(activity.OverlapPolicy)
+	if !activity.IsValidOverlapPolicy() {
+		return fmt.Errorf("Invalid overlap policy %q", activity.OverlapPolicy)
+	}
+	activity.DefinedProperties = ensureBuiltInProperties(definedProperties)
+
+	if !importer.dryRun {
+		if err := activity.ImportActivity(); err != nil {
+			return err
+		}
+	}
+	importer.activities[activity.ID] = &activity
+	counts.Created++
+	return nil
+}
+
+// importEvent remaps the references of the event of the line and adds it to the batch
+func (importer *ndjsonImporter) importEvent(event models.Event, line int) error {
+	activity, err := importer.activity(event.ActivityID)
+	if err != nil {
+		return err
+	}
+	event.ActivityID = activity.ID
+
+	definedProperties := make(map[primitive.ObjectID]*models.Property)
+	for _, id := range activity.DefinedProperties {
+		property, err := importer.localProperty(id)
+		if err != nil {
+			return err
+		}
+		definedProperties[id] = property
+	}
+
+	propertyValues := make(map[primitive.ObjectID]interface{})
+	for _, pair := range event.PropertyValues {
+		property, err := importer.property(pair.Key)
+		if err != nil {
+			return err
+		}
+		if _, isDefined := definedProperties[property.ID]; !isDefined {
+			return fmt.Errorf("Property %q is not defined on the activity %q", property.Name, activity.Name)
+		}
+
+		// The computed values are recomputed and the missing values get the default values
+		if property.Formula != "" || pair.Value == nil {
+			continue
+		}
+		// The values are checked like the values of the created events
+		value, err := checkPropertyValue(property, pair.Value)
+		if err != nil {
+			return err
+		}
+		propertyValues[property.ID] = value
+	}
+
+	// The properties that the event does not have get their default values
+	for id, property := range definedProperties {
+		if _, isExist := propertyValues[id]; !isExist {
+			propertyValues[id] = defaultPropertyValue(property, event.OccurredTime())
+		}
+	}
+
+	event.PropertyValues = PropertyValueConvertion(propertyValues)
+	if err := computeValues(event.PropertyValues, definedProperties); err != nil {
+		return err
+	}
+
+	importer.batch = append(importer.batch, &event)
+	importer.batchLines = append(importer.batchLines, line)
+	if len(importer.batch) == importBatchSize {
+		importer.flush()
+	}
+	return nil
+}
+
+// flush inserts the batch of the events, the events that already exist are skipped.
+// The events that are rejected are reported on their lines, if the whole batch fails
+// the error is reported on the lines of all of its events.
+func (importer *ndjsonImporter) flush() {
+	if len(importer.batch) == 0 {
+		return
+	}
+	if err := importer.insertBatch(); err != nil {
+		for _, line := range importer.batchLines {
+			importer.report.Errors = append(importer.report.Errors, ImportError{Line: line, Error: err.Error()})
+		}
+	}
+	importer.batch = importer.batch[:0]
+	importer.batchLines = importer.batchLines[:0]
+}
+
+func (importer *ndjsonImporter) insertBatch() error {
+	ids := make([]primitive.ObjectID, 0, len(importer.batch))
+	for _, event := range importer.batch {
+		ids = append(ids, event.ID)
+	}
+	existingEvents, err := models.GetEventsByFilter(bson.M{"_id": bson.M{"$in": ids}})
+	if err != nil {
+		return err
+	}
+	existing := make(map[primitive.ObjectID]bool)
+	for _, event := range existingEvents {
+		existing[event.ID] = true
+	}
+
+	var events []*models.Event
+	var lines []int
+	for i, event := range importer.batch {
+		if !existing[event.ID] {
+			events = append(events, event)
+			lines = append(lines, importer.batchLines[i])
+		}
+	}
+
+	var rejected []ImportError
+	if !importer.dryRun {
+		err := models.ImportEvents(events)
+		if insertErrs, isInsertErrs := err.(models.InsertErrors); isInsertErrs {
+			for index, insertErr := range insertErrs {
+				rejected = append(rejected, ImportError{Line: lines[index], Error: insertErr.Error()})
+			}
+			sort.Slice(rejected, func(i, j int) bool { return rejected[i].Line < rejected[j].Line })
+		} else if err != nil {
+			return err
+		}
+	}
+
+	importer.report.Errors = append(importer.report.Errors, rejected...)
+	importer.report.Events.Created += len(events) - len(rejected)
+	importer.report.Events.Skipped += len(existing)
+	return nil
+}
+
+// importRecord decodes and imports a record, the pending events are inserted
+// before the other records because they may change the activities
+func (importer *ndjsonImporter) importRecord(record NDJSONRecord, line int) error {
+	switch record.Type {
+	case RecordProperty:
+		var property models.Property
+		if err := json.Unmarshal(record.Data, &property); err != nil {
+			return err
+		}
+		importer.flush()
+		return importer.importProperty(property)
+	case RecordActivity:
+		var activity models.Activity
+		if err := json.Unmarshal(record.Data, &activity); err != nil {
+			return err
+		}
+		importer.flush()
+		return importer.importActivity(activity)
+	case RecordEvent:
+		var event models.Event
+		if err := json.Unmarshal(record.Data, &event); err != nil {
+			return err
+		}
+		if event.ID.IsZero() {
+			return errors.New("Event has no ID")
+		}
+		return importer.importEvent(event, line)
+	}
+	return fmt.Errorf("Unknown record type %q", record.Type)
+}
+
+// ImportNDJSON imports the records of an NDJSON export line by line, the IDs of the records are
+// kept and the records that exist with the same name are matched. Nothing is written on a dry run.
+// The invalid records are reported with their lines, the returned error stops the import.
+func ImportNDJSON(file io.Reader, dryRun bool) (*NDJSONImportReport, error) {
+	importer := &ndjsonImporter{
+		dryRun:          dryRun,
+		report:          &NDJSONImportReport{DryRun: dryRun, Errors: []ImportError{}},
+		properties:      make(map[primitive.ObjectID]*models.Property),
+		activities:      make(map[primitive.ObjectID]*models.Activity),
+		localProperties: make(map[primitive.ObjectID]*models.Property),
+	}
+
+	reader := bufio.NewReader(file)
+	for line := 1; ; line++ {
+		content, err := reader.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return importer.report, err
+		}
+
+		if content = bytes.TrimSpace(content); len(content) != 0 {
+			var record NDJSONRecord
+			recordErr := json.Unmarshal(content, &record)
+			if recordErr == nil {
+				recordErr = importer.importRecord(record, line)
+			}
+			if recordErr != nil {
+				importer.report.Errors = append(importer.report.Errors, ImportError{Line: line, Error: recordErr.Error()})
+			}
+		}
+
+		if err == io.EOF {
+			break
+		}
+	}
+
+	importer.flush()
+	return importer.report, nil
+}
+
+// ImportNDJSONHandler imports the NDJSON body that is in the format of the NDJSON export
+// e.g. /import/ndjson?dryRun=true
+func ImportNDJSONHandler(w http.ResponseWriter, r *http.Request) {
+	dryRun := false
+	if value := r.URL.Query().Get("dryRun"); value != "" {
+		var err error
+		if dryRun, err = strconv.ParseBool(value); err != nil {
+			http.Error(w, "Invalid dryRun.", http.StatusBadRequest)
+			return
+		}
+	}
+	defer r.Body.Close()
+
+	report, err := ImportNDJSON(r.Body, dryRun)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(report)
+}
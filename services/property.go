@@ -2,6 +2,7 @@ package services
 
 import (
 	"encoding/json"
+	"io"
 	"net/http"
 
 	"github.com/djamysh/PensieveAPI/models"
@@ -23,9 +24,18 @@ func CreatePropertyHandler(w http.ResponseWriter, r *http.Request) {
 
 	// Insert the property into the MongoDB collection
 	property.ID = primitive.NewObjectID()
+	// Only the server defines the built-in properties
+	property.System = false
 
 	property.ValueDataType = utils.CleanInput(property.ValueDataType)
 
+	if property.Formula != "" {
+		if err := validateFormula(&property); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
 	if !property.IsValidType() {
 
 		// When the given input is invalid
@@ -198,17 +208,106 @@ func UpdatePropertyHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Parse the request body to get the updated property
-	var property models.Property
-	err = json.NewDecoder(r.Body).Decode(&property)
+	body, err := io.ReadAll(r.Body)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 	defer r.Body.Close()
 
+	var property models.Property
+	if err := json.Unmarshal(body, &property); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// An explicitly given empty formula removes the formula, a not given one keeps it
+	var formulaRequest struct {
+		Formula *string `json:"formula"`
+	}
+	if err := json.Unmarshal(body, &formulaRequest); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
 	// Update the property in the MongoDB collection
 	property.ID = id
 
+	previousProperty, err := models.GetProperty(id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	// Built-in properties are looked up by name, therefore both name and type are protected
+	if previousProperty.System && ((property.Name != "" && property.Name != previousProperty.Name) ||
+		(property.ValueDataType != "" && utils.CleanInput(property.ValueDataType) != previousProperty.ValueDataType)) {
+		http.Error(w, "Name and value data type of a built-in property can not be changed.", http.StatusForbidden)
+		return
+	}
+
+	// Formulas reference the properties by name and expect their types
+	if (property.Name != "" && property.Name != previousProperty.Name) ||
+		(property.ValueDataType != "" && utils.CleanInput(property.ValueDataType) != previousProperty.ValueDataType) {
+		dependents, err := formulaDependents(previousProperty.Name)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if len(dependents) != 0 {
+			http.Error(w, "Name and value data type of a property that is referenced by a formula can not be changed.", http.StatusConflict)
+			return
+		}
+	}
+
+	// Sum goals sum the number values of the property
+	if property.ValueDataType != "" && utils.CleanInput(property.ValueDataType) != previousProperty.ValueDataType {
+		goals, err := sumGoals(id)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if len(goals) != 0 {
+			http.Error(w, "Value data type of a property that is referenced by a sum goal can not be changed.", http.StatusConflict)
+			return
+		}
+	}
+
+	property.Formula = previousProperty.Formula
+	formulaChanged := formulaRequest.Formula != nil && *formulaRequest.Formula != previousProperty.Formula
+	if formulaChanged {
+		property.Formula = *formulaRequest.Formula
+	}
+
+	// Computed properties can not be referenced by the other formulas
+	if formulaChanged && property.Formula != "" {
+		dependents, err := formulaDependents(previousProperty.Name)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if len(dependents) != 0 {
+			http.Error(w, "Property that is referenced by a formula can not be a computed property.", http.StatusConflict)
+			return
+		}
+	}
+
+	// The resulting computed property is validated with its resulting name and type
+	recomputeFlag := false
+	if property.Formula != "" {
+		computed := property
+		if computed.Name == "" {
+			computed.Name = previousProperty.Name
+		}
+		if computed.ValueDataType == "" {
+			computed.ValueDataType = previousProperty.ValueDataType
+		}
+		computed.ValueDataType = utils.CleanInput(computed.ValueDataType)
+		if err := validateFormula(&computed); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		recomputeFlag = formulaChanged
+	}
+
 	update := make(map[string]interface{})
 
 	updateRelationsFlag := false
@@ -225,13 +324,17 @@ func UpdatePropertyHandler(w http.ResponseWriter, r *http.Request) {
 		if !property.IsValidType() {
 			// If not a valid property value type
 			// When the given input is invalid
-			http.Error(w, err.Error(), http.StatusNotAcceptable)
+			http.Error(w, "Invalid data type.", http.StatusNotAcceptable)
 			return
 		}
 		update["valueDataType"] = property.ValueDataType
 		updateRelationsFlag = true
 	}
 
+	if formulaChanged {
+		update["formula"] = property.Formula
+	}
+
 	bsonUpdate := bson.M(update)
 	oldValue, err := models.UpdateProperty(id, bsonUpdate)
 
@@ -259,10 +362,31 @@ func UpdatePropertyHandler(w http.ResponseWriter, r *http.Request) {
 
 	}
 
+	if recomputeFlag {
+		if err := recomputePropertysEvents(id); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
 	// Send a response indicating that the property was updated successfully
 	json.NewEncoder(w).Encode(oldValue)
 }
 
+// deleteProperty deletes the property, its values of the events and its goals
+func deleteProperty(id primitive.ObjectID) error {
+	if err := models.DeleteProperty(id); err != nil {
+		return err
+	}
+
+	if err := DeletePropertysRelations(id); err != nil {
+		return err
+	}
+
+	// Goals can not be computed without their property
+	return models.DeleteGoalsByFilter(bson.M{"propertyID": id})
+}
+
 func DeletePropertyHandler(w http.ResponseWriter, r *http.Request) {
 	// Get the property ID from the URL
 	vars := mux.Vars(r)
@@ -272,17 +396,30 @@ func DeletePropertyHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err = models.DeleteProperty(id)
+	property, err := models.GetProperty(id)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if property.System {
+		http.Error(w, "Built-in property can not be deleted.", http.StatusForbidden)
 		return
 	}
 
-	err = DeletePropertysRelations(id)
+	dependents, err := formulaDependents(property.Name)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	if len(dependents) != 0 {
+		http.Error(w, "Property that is referenced by a formula can not be deleted.", http.StatusConflict)
+		return
+	}
+
+	if err := deleteProperty(id); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
 
 	// Send a response indicating that the property was deleted successfully
 	w.WriteHeader(http.StatusNoContent)
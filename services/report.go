@@ -0,0 +1,183 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/djamysh/PensieveAPI/models"
+	"github.com/djamysh/PensieveAPI/utils"
+)
+
+// Common parts of the report endpoints, /reports/{report}/{activityID}
+
+var NumberPropertyErr = errors.New("Property must be a number property")
+
+// maxReportDays bounds the ranges of the reports that have an entry for each day
+const maxReportDays = 5 * 366
+
+var DayRangeErr = fmt.Errorf("Range must not be longer than %d days", maxReportDays)
+
+// checkDayRange checks that the days from first to last, both inclusive, are not more than maxReportDays
+func checkDayRange(first, last time.Time) error {
+	// Days may be 23 or 25 hours long because of DST
+	if days := math.Round(last.Sub(first).Hours()/24) + 1; days > maxReportDays {
+		return DayRangeErr
+	}
+	return nil
+}
+
+type reportParams struct {
+	// Zero value means all activities, for the reports that are not activity specific
+	ActivityID primitive.ObjectID
+	Location   *time.Location
+	// Optional range of the occurredAt, zero values mean unbounded
+	From time.Time
+	To   time.Time
+}
+
+// parseReportParams parses the activityID from the URL, or from the optional activityID
+// query parameter if the route does not have it, and the tz, from and to query parameters
+func parseReportParams(r *http.Request) (*reportParams, error) {
+	var params reportParams
+	var err error
+
+	hex, isRouteParam := mux.Vars(r)["activityID"]
+	if !isRouteParam {
+		hex = r.URL.Query().Get("activityID")
+	}
+	if isRouteParam || hex != "" {
+		if params.ActivityID, err = primitive.ObjectIDFromHex(hex); err != nil {
+			return nil, err
+		}
+	}
+	if params.Location, err = requestLocation(r); err != nil {
+		return nil, err
+	}
+	if params.From, params.To, err = timeRange(r, params.Location); err != nil {
+		return nil, err
+	}
+	return &params, nil
+}
+
+// matchStage matches the events of the activity that occurred in the range
+func (params *reportParams) matchStage() bson.M {
+	return bson.M{"$match": params.filter()}
+}
+
+// filter is the filter of the events of the activity that occurred in the range
+func (params *reportParams) filter() bson.M {
+	filter := bson.M{}
+	if !params.ActivityID.IsZero() {
+		filter["activityID"] = params.ActivityID
+	}
+	filter = occurredAtFilter(filter, params.From, params.To)
+	if _, isRange := filter["occurredAt"]; !isRange {
+		filter["occurredAt"] = bson.M{"$type": "date"}
+	}
+	return filter
+}
+
+// resolveProperty finds the property by its ID or by its name
+func resolveProperty(value string) (*models.Property, error) {
+	if id, err := primitive.ObjectIDFromHex(value); err == nil {
+		return models.GetProperty(id)
+	}
+	return models.GetPropertyByName(value)
+}
+
+// resolveNumberProperty finds the property and checks that it is a number property
+func resolveNumberProperty(value string) (*models.Property, error) {
+	property, err := resolveProperty(value)
+	if err != nil {
+		return nil, err
+	}
+	if property.ValueDataType != "number" {
+		return nil, NumberPropertyErr
+	}
+	return property, nil
+}
+
+// propertyValueExpression is the aggregation expression that extracts
+// the value of the given property from the propertyValues of an event.
+func propertyValueExpression(propertyID primitive.ObjectID) bson.M {
+	return bson.M{
+		"$arrayElemAt": bson.A{
+			bson.M{
+				"$map": bson.M{
+					"input": bson.M{
+						"$filter": bson.M{
+							"input": "$propertyValues",
+							"as":    "pair",
+							"cond":  bson.M{"$eq": bson.A{"$$pair.key", propertyID}},
+						},
+					},
+					"as": "pair",
+					"in": "$$pair.value",
+				},
+			},
+			0,
+		},
+	}
+}
+
+// percentile computes the p-th percentile of the sorted values with linear interpolation
+func percentile(sorted []float64, p float64) float64 {
+	if len(sorted) == 0 {
+		return math.NaN()
+	}
+	rank := p / 100 * float64(len(sorted)-1)
+	lower := int(math.Floor(rank))
+	upper := int(math.Ceil(rank))
+	return sorted[lower] + (rank-float64(lower))*(sorted[upper]-sorted[lower])
+}
+
+// sortedCopy returns the sorted copy of the values
+func sortedCopy(values []float64) []float64 {
+	sorted := append([]float64(nil), values...)
+	sort.Float64s(sorted)
+	return sorted
+}
+
+type dailyValue struct {
+	Count int64
+	Sum   float64
+}
+
+// dailyValues computes the number of events and the sum of the given number
+// property per day in the request's timezone, property may be nil.
+func dailyValues(params *reportParams, property *models.Property) (map[time.Time]*dailyValue, error) {
+	filter := occurredAtFilter(bson.M{"activityID": params.ActivityID}, params.From, params.To)
+	events, err := models.GetEventsByFilter(filter)
+	if err != nil {
+		return nil, err
+	}
+
+	days := make(map[time.Time]*dailyValue)
+	for i := range events {
+		day := utils.BucketStart(events[i].OccurredTime(), utils.BucketDay, params.Location)
+		if days[day] == nil {
+			days[day] = &dailyValue{}
+		}
+		days[day].Count++
+
+		if property == nil {
+			continue
+		}
+		for _, pair := range events[i].PropertyValues {
+			if pair.Key == property.ID {
+				if value, ok := utils.ToFloat64(pair.Value); ok {
+					days[day].Sum += value
+				}
+			}
+		}
+	}
+	return days, nil
+}
@@ -0,0 +1,808 @@
+package services
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"gopkg.in/yaml.v3"
+
+	"github.com/djamysh/PensieveAPI/models"
+	"github.com/djamysh/PensieveAPI/utils"
+)
+
+// Declarative schema of the properties and the activities. The records are matched
+// with the database by their names, plan diffs the schema with the database and
+// apply makes the database match the schema with the same cascades as the handlers.
+// The built-in properties are not in the schema, every activity defines them.
+
+const (
+	ChangeCreate = "create"
+	ChangeUpdate = "update"
+	ChangeDelete = "delete"
+)
+
+const (
+	SchemaKindProperty = "property"
+	SchemaKindActivity = "activity"
+)
+
+type SchemaProperty struct {
+	Name        string `json:"name" yaml:"name"`
+	Description string `json:"description,omitempty" yaml:"description,omitempty"`
+	Type        string `json:"type" yaml:"type"`
+	// Formula of a computed property
+	Formula string `json:"formula,omitempty" yaml:"formula,omitempty"`
+}
+
+type SchemaActivity struct {
+	Name                  string `json:"name" yaml:"name"`
+	Description           string `json:"description,omitempty" yaml:"description,omitempty"`
+	OverlapPolicy         string `json:"overlapPolicy,omitempty" yaml:"overlapPolicy,omitempty"`
+	AllowConcurrentTimers bool   `json:"allowConcurrentTimers,omitempty" yaml:"allowConcurrentTimers,omitempty"`
+	// Names of the defined properties
+	Properties []string `json:"properties" yaml:"properties"`
+}
+
+type Schema struct {
+	Properties []SchemaProperty `json:"properties" yaml:"properties"`
+	Activities []SchemaActivity `json:"activities" yaml:"activities"`
+}
+
+type FieldChange struct {
+	From interface{} `json:"from"`
+	To   interface{} `json:"to"`
+}
+
+type SchemaChange struct {
+	Action string                 `json:"action"`
+	Kind   string                 `json:"kind"`
+	Name   string                 `json:"name"`
+	Fields map[string]FieldChange `json:"fields,omitempty"`
+	// Effects of the change on the other records
+	Cascades []string `json:"cascades,omitempty"`
+}
+
+// SchemaError is an invalid schema, or a schema that can not be applied to the database
+type SchemaError struct {
+	Message string
+}
+
+func (err *SchemaError) Error() string {
+	return err.Message
+}
+
+func schemaErrorf(format string, args ...interface{}) error {
+	return &SchemaError{Message: fmt.Sprintf(format, args...)}
+}
+
+// EmptySchemaErr rejects an empty document, which would prune everything on apply
+var EmptySchemaErr = &SchemaError{Message: "Schema is empty."}
+
+// ParseSchema parses a YAML or JSON schema document, an empty document is rejected
+func ParseSchema(data []byte) (*Schema, error) {
+	var schema Schema
+	if len(bytes.TrimSpace(data)) == 0 {
+		return nil, EmptySchemaErr
+	}
+	// JSON is mostly valid YAML, but not with the tab indentation
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte("{")) {
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&schema); err != nil {
+			return nil, schemaErrorf("Invalid schema: %v", err)
+		}
+		return &schema, nil
+	}
+
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&schema); err == io.EOF {
+		// Only comments
+		return nil, EmptySchemaErr
+	} else if err != nil {
+		return nil, schemaErrorf("Invalid schema: %v", err)
+	}
+	return &schema, nil
+}
+
+// IsDestructive reports whether the changes delete records or change the values of the events
+func IsDestructive(changes []SchemaChange) bool {
+	for _, change := range changes {
+		if change.Action == ChangeDelete || len(change.Cascades) != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// CurrentSchema returns the schema of the properties and the activities in the database
+func CurrentSchema() (*Schema, error) {
+	properties, err := models.GetPropertiesByFilter(bson.M{"system": bson.M{"$ne": true}})
+	if err != nil {
+		return nil, err
+	}
+	activities, err := models.GetActivitiesByFilter(bson.M{})
+	if err != nil {
+		return nil, err
+	}
+
+	names := make(map[primitive.ObjectID]string)
+	schema := &Schema{Properties: []SchemaProperty{}, Activities: []SchemaActivity{}}
+	for _, property := range properties {
+		names[property.ID] = property.Name
+		schema.Properties = append(schema.Properties, SchemaProperty{
+			Name:        property.Name,
+			Description: property.Description,
+			Type:        property.ValueDataType,
+			Formula:     property.Formula,
+		})
+	}
+	for _, activity := range activities {
+		schemaActivity := SchemaActivity{
+			Name:                  activity.Name,
+			Description:           activity.Description,
+			OverlapPolicy:         activity.OverlapPolicy,
+			AllowConcurrentTimers: activity.AllowsConcurrentTimers(),
+			Properties:            []string{},
+		}
+		for _, id := range activity.DefinedProperties {
+			// The built-in properties are not named in the schema
+			if name, isExist := names[id]; isExist {
+				schemaActivity.Properties = append(schemaActivity.Properties, name)
+			}
+		}
+		schema.Activities = append(schema.Activities, schemaActivity)
+	}
+	return schema, nil
+}
+
+// schemaPlanner diffs the schema with the database and applies the changes
+type schemaPlanner struct {
+	schema *Schema
+	prune  bool
+	// Records in the database by name
+	properties map[string]*models.Property
+	activities map[string]*models.Activity
+	// Properties after the changes by name, the created ones have no ID until they are applied
+	target  map[string]*models.Property
+	changes []SchemaChange
+	// Properties whose types change, the computed properties that reference them are recomputed
+	retyped map[string]bool
+}
+
+// normalizedOverlapPolicy treats the not set overlap policy as allow
+func normalizedOverlapPolicy(policy string) string {
+	if policy == "" {
+		return models.OverlapAllow
+	}
+	return policy
+}
+
+// validate normalizes the schema and checks it against the target state of the properties
+func (planner *schemaPlanner) validate() error {
+	schema := planner.schema
+
+	inSchema := make(map[string]bool)
+	for i := range schema.Properties {
+		property := &schema.Properties[i]
+		property.Type = utils.CleanInput(property.Type)
+		if property.Type == "" && property.Formula != "" {
+			property.Type = "number"
+		}
+		if property.Name == "" {
+			return schemaErrorf("Property without a name")
+		}
+		if inSchema[property.Name] {
+			return schemaErrorf("Property %q is defined more than once", property.Name)
+		}
+		inSchema[property.Name] = true
+	}
+
+	// Properties that are not in the schema stay unless they are pruned
+	planner.target = make(map[string]*models.Property)
+	for name, property := range planner.properties {
+		if !planner.prune || property.System {
+			planner.target[name] = property
+		}
+	}
+
+	for _, schemaProperty := range schema.Properties {
+		property := &models.Property{
+			Name:          schemaProperty.Name,
+			Description:   schemaProperty.Description,
+			ValueDataType: schemaProperty.Type,
+			Formula:       schemaProperty.Formula,
+		}
+		if !property.IsValidType() {
+			return schemaErrorf("Property %q has the invalid data type %q", property.Name, property.ValueDataType)
+		}
+
+		if existing, isExist := planner.properties[property.Name]; isExist {
+			if existing.System && (existing.ValueDataType != property.ValueDataType || property.Formula != "") {
+				return schemaErrorf("Value data type and formula of the built-in property %q can not be changed", property.Name)
+			}
+			property.ID = existing.ID
+			property.System = existing.System
+		}
+		planner.target[property.Name] = property
+	}
+
+	// Every formula must be valid with the target properties, including the ones that are not in the schema
+	lookup := func(name string) (*models.Property, error) {
+		if property, isExist := planner.target[name]; isExist {
+			return property, nil
+		}
+		return nil, fmt.Errorf("Unknown property %q", name)
+	}
+	for _, property := range planner.target {
+		if property.Formula == "" {
+			continue
+		}
+		if err := validateFormulaWith(property, lookup); err != nil {
+			return schemaErrorf("Property %q: %v", property.Name, err)
+		}
+	}
+
+	inActivities := make(map[string]bool)
+	for i := range schema.Activities {
+		activity := &schema.Activities[i]
+		activity.OverlapPolicy = utils.CleanInput(activity.OverlapPolicy)
+		if activity.Name == "" {
+			return schemaErrorf("Activity without a name")
+		}
+		if inActivities[activity.Name] {
+			return schemaErrorf("Activity %q is defined more than once", activity.Name)
+		}
+		inActivities[activity.Name] = true
+
+		if !(&models.Activity{OverlapPolicy: activity.OverlapPolicy}).IsValidOverlapPolicy() {
+			return schemaErrorf("Activity %q has the invalid overlap policy %q", activity.Name, activity.OverlapPolicy)
+		}
+		// Built-in properties are always defined, naming them changes nothing
+		properties := make([]string, 0, len(activity.Properties))
+		for _, name := range activity.Properties {
+			property, isExist := planner.target[name]
+			if !isExist {
+				return schemaErrorf("Activity %q defines the unknown property %q", activity.Name, name)
+			}
+			if !property.System {
+				properties = append(properties, name)
+			}
+		}
+		activity.Properties = properties
+	}
+	return nil
+}
+
+// countValues returns the number of the events that have a value of the property
+func countValues(filter bson.M, propertyID primitive.ObjectID) (int64, error) {
+	filter["propertyValues.key"] = propertyID
+	return models.CountEvents(filter)
+}
+
+func (planner *schemaPlanner) planProperty(schemaProperty SchemaProperty) error {
+	existing, isExist := planner.properties[schemaProperty.Name]
+	if !isExist {
+		planner.changes = append(planner.changes, SchemaChange{Action: ChangeCreate, Kind: SchemaKindProperty, Name: schemaProperty.Name})
+		return nil
+	}
+
+	change := SchemaChange{Action: ChangeUpdate, Kind: SchemaKindProperty, Name: existing.Name, Fields: map[string]FieldChange{}}
+	if existing.Description != schemaProperty.Description {
+		change.Fields["description"] = FieldChange{existing.Description, schemaProperty.Description}
+	}
+	if existing.ValueDataType != schemaProperty.Type {
+		goals, err := sumGoals(existing.ID)
+		if err != nil {
+			return err
+		}
+		if len(goals) != 0 {
+			return schemaErrorf("Type of property %q can not be changed, it is referenced by the sum goal %q", existing.Name, goals[0].Name)
+		}
+		change.Fields["type"] = FieldChange{existing.ValueDataType, schemaProperty.Type}
+		count, err := countValues(bson.M{}, existing.ID)
+		if err != nil {
+			return err
+		}
+		change.Cascades = append(change.Cascades, fmt.Sprintf("Values of %d events are reset to the null value of %s", count, schemaProperty.Type))
+		planner.retyped[existing.Name] = true
+	}
+	if existing.Formula != schemaProperty.Formula {
+		change.Fields["formula"] = FieldChange{existing.Formula, schemaProperty.Formula}
+		if schemaProperty.Formula != "" {
+			count, err := countValues(bson.M{}, existing.ID)
+			if err != nil {
+				return err
+			}
+			change.Cascades = append(change.Cascades, fmt.Sprintf("Values of %d events are recomputed", count))
+		}
+	}
+
+	if len(change.Fields) != 0 {
+		planner.changes = append(planner.changes, change)
+	}
+	return nil
+}
+
+// definedPropertyNames returns the names of the defined properties of the activity except the built-in ones
+func (planner *schemaPlanner) definedPropertyNames(activity *models.Activity) []string {
+	names := make(map[primitive.ObjectID]string)
+	for name, property := range planner.properties {
+		names[property.ID] = name
+	}
+
+	var defined []string
+	for _, id := range activity.DefinedProperties {
+		if name, isExist := names[id]; isExist && !isBuiltInProperty(id) {
+			defined = append(defined, name)
+		}
+	}
+	return defined
+}
+
+func (planner *schemaPlanner) planActivity(schemaActivity SchemaActivity) error {
+	existing, isExist := planner.activities[schemaActivity.Name]
+	if !isExist {
+		planner.changes = append(planner.changes, SchemaChange{Action: ChangeCreate, Kind: SchemaKindActivity, Name: schemaActivity.Name})
+		return nil
+	}
+
+	change := SchemaChange{Action: ChangeUpdate, Kind: SchemaKindActivity, Name: existing.Name, Fields: map[string]FieldChange{}}
+	if existing.Description != schemaActivity.Description {
+		change.Fields["description"] = FieldChange{existing.Description, schemaActivity.Description}
+	}
+	if normalizedOverlapPolicy(existing.OverlapPolicy) != normalizedOverlapPolicy(schemaActivity.OverlapPolicy) {
+		change.Fields["overlapPolicy"] = FieldChange{existing.OverlapPolicy, schemaActivity.OverlapPolicy}
+	}
+	if existing.AllowsConcurrentTimers() != schemaActivity.AllowConcurrentTimers {
+		change.Fields["allowConcurrentTimers"] = FieldChange{existing.AllowsConcurrentTimers(), schemaActivity.AllowConcurrentTimers}
+	}
+
+	current := planner.definedPropertyNames(existing)
+	isCurrent := make(map[string]bool)
+	for _, name := range current {
+		isCurrent[name] = true
+	}
+	isTarget := make(map[string]bool)
+	for _, name := range schemaActivity.Properties {
+		isTarget[name] = true
+	}
+
+	var added, removed []string
+	for _, name := range schemaActivity.Properties {
+		if !isCurrent[name] {
+			added = append(added, name)
+		}
+	}
+	for _, name := range current {
+		if !isTarget[name] {
+			removed = append(removed, name)
+		}
+	}
+
+	if len(added) != 0 || len(removed) != 0 {
+		change.Fields["properties"] = FieldChange{current, schemaActivity.Properties}
+		count, err := models.CountEvents(bson.M{"activityID": existing.ID})
+		if err != nil {
+			return err
+		}
+		if len(added) != 0 {
+			change.Cascades = append(change.Cascades, fmt.Sprintf("%d events get the default values of %s", count, strings.Join(added, ", ")))
+		}
+		if len(removed) != 0 {
+			change.Cascades = append(change.Cascades, fmt.Sprintf("Values of %s are removed from %d events", strings.Join(removed, ", "), count))
+		}
+	}
+
+	if len(change.Fields) != 0 {
+		planner.changes = append(planner.changes, change)
+	}
+	return nil
+}
+
+func (planner *schemaPlanner) planPrune() error {
+	inSchema := make(map[string]bool)
+	for _, activity := range planner.schema.Activities {
+		inSchema[activity.Name] = true
+	}
+	var activityNames []string
+	for name := range planner.activities {
+		if !inSchema[name] {
+			activityNames = append(activityNames, name)
+		}
+	}
+	sort.Strings(activityNames)
+
+	for _, name := range activityNames {
+		count, err := models.CountEvents(bson.M{"activityID": planner.activities[name].ID})
+		if err != nil {
+			return err
+		}
+		planner.changes = append(planner.changes, SchemaChange{
+			Action:   ChangeDelete,
+			Kind:     SchemaKindActivity,
+			Name:     name,
+			Cascades: []string{fmt.Sprintf("%d events and the goals of the activity are deleted", count)},
+		})
+	}
+
+	// Computed properties are deleted before the properties that they reference
+	var propertyNames []string
+	for name := range planner.properties {
+		if _, isExist := planner.target[name]; !isExist {
+			propertyNames = append(propertyNames, name)
+		}
+	}
+	sort.Slice(propertyNames, func(i, j int) bool {
+		iComputed := planner.properties[propertyNames[i]].Formula != ""
+		jComputed := planner.properties[propertyNames[j]].Formula != ""
+		if iComputed != jComputed {
+			return iComputed
+		}
+		return propertyNames[i] < propertyNames[j]
+	})
+
+	for _, name := range propertyNames {
+		count, err := countValues(bson.M{}, planner.properties[name].ID)
+		if err != nil {
+			return err
+		}
+		planner.changes = append(planner.changes, SchemaChange{
+			Action:   ChangeDelete,
+			Kind:     SchemaKindProperty,
+			Name:     name,
+			Cascades: []string{fmt.Sprintf("Values are removed from %d events, the goals of the property are deleted", count)},
+		})
+	}
+	return nil
+}
+
+func newSchemaPlanner(schema *Schema, prune bool) (*schemaPlanner, error) {
+	planner := &schemaPlanner{
+		schema:     schema,
+		prune:      prune,
+		properties: make(map[string]*models.Property),
+		activities: make(map[string]*models.Activity),
+		changes:    []SchemaChange{},
+		retyped:    make(map[string]bool),
+	}
+
+	properties, err := models.GetPropertiesByFilter(bson.M{})
+	if err != nil {
+		return nil, err
+	}
+	for i := range properties {
+		planner.properties[properties[i].Name] = &properties[i]
+	}
+	activities, err := models.GetActivitiesByFilter(bson.M{})
+	if err != nil {
+		return nil, err
+	}
+	for i := range activities {
+		planner.activities[activities[i].Name] = &activities[i]
+	}
+
+	if err := planner.validate(); err != nil {
+		return nil, err
+	}
+
+	// The properties are created before the computed properties that reference them
+	for _, computed := range []bool{false, true} {
+		for _, property := range schema.Properties {
+			if (property.Formula != "") != computed {
+				continue
+			}
+			if err := planner.planProperty(property); err != nil {
+				return nil, err
+			}
+		}
+	}
+	for _, activity := range schema.Activities {
+		if err := planner.planActivity(activity); err != nil {
+			return nil, err
+		}
+	}
+	if prune {
+		if err := planner.planPrune(); err != nil {
+			return nil, err
+		}
+	}
+	return planner, nil
+}
+
+func (planner *schemaPlanner) applyProperty(change SchemaChange) error {
+	property := planner.target[change.Name]
+	switch change.Action {
+	case ChangeCreate:
+		property.ID = primitive.NewObjectID()
+		property.System = false
+		return property.CreateProperty()
+	case ChangeDelete:
+		return deleteProperty(planner.properties[change.Name].ID)
+	}
+
+	update := bson.M{}
+	if field, isExist := change.Fields["description"]; isExist {
+		update["description"] = field.To
+	}
+	if field, isExist := change.Fields["type"]; isExist {
+		update["valueDataType"] = field.To
+	}
+	if field, isExist := change.Fields["formula"]; isExist {
+		update["formula"] = field.To
+	}
+	if _, err := models.UpdateProperty(property.ID, update); err != nil {
+		return err
+	}
+
+	if _, isExist := change.Fields["type"]; isExist {
+		if err := UpdatePropertysRelations(property.ID, property.ValueDataType); err != nil {
+			return err
+		}
+	}
+	if _, isExist := change.Fields["formula"]; isExist && property.Formula != "" {
+		return recomputePropertysEvents(property.ID)
+	}
+	return nil
+}
+
+// definedPropertyIDs returns the IDs of the named properties with the built-in properties
+func (planner *schemaPlanner) definedPropertyIDs(names []string) []primitive.ObjectID {
+	ids := make([]primitive.ObjectID, 0, len(names))
+	for _, name := range names {
+		ids = append(ids, planner.target[name].ID)
+	}
+	return ensureBuiltInProperties(ids)
+}
+
+func (planner *schemaPlanner) applyActivity(change SchemaChange, schemaActivity SchemaActivity) error {
+	switch change.Action {
+	case ChangeCreate:
+		activity := models.Activity{
+			Name:              schemaActivity.Name,
+			Description:       schemaActivity.Description,
+			OverlapPolicy:     schemaActivity.OverlapPolicy,
+			DefinedProperties: planner.definedPropertyIDs(schemaActivity.Properties),
+		}
+		if schemaActivity.AllowConcurrentTimers {
+			activity.AllowConcurrentTimers = &schemaActivity.AllowConcurrentTimers
+		}
+		return activity.CreateActivity()
+	case ChangeDelete:
+		return deleteActivity(planner.activities[change.Name].ID)
+	}
+
+	existing := planner.activities[change.Name]
+	update := bson.M{}
+	if _, isExist := change.Fields["description"]; isExist {
+		update["description"] = schemaActivity.Description
+	}
+	if _, isExist := change.Fields["overlapPolicy"]; isExist {
+		update["overlapPolicy"] = schemaActivity.OverlapPolicy
+	}
+	if _, isExist := change.Fields["allowConcurrentTimers"]; isExist {
+		if err := setRunningTimers(existing.ID, schemaActivity.AllowConcurrentTimers); err != nil {
+			return err
+		}
+		update["allowConcurrentTimers"] = schemaActivity.AllowConcurrentTimers
+	}
+	if _, isExist := change.Fields["properties"]; isExist {
+		definedProperties := planner.definedPropertyIDs(schemaActivity.Properties)
+		// Relations must be updated before the activity, because the
+		// difference is computed from the stored definedProperties
+		if err := UpdateActivityEventRelations(existing.ID, definedProperties); err != nil {
+			return err
+		}
+		update["definedProperties"] = definedProperties
+	}
+	_, err := models.UpdateActivity(existing.ID, update)
+	return err
+}
+
+// apply applies the planned changes in order and returns the applied ones
+func (planner *schemaPlanner) apply() ([]SchemaChange, error) {
+	applied := []SchemaChange{}
+	schemaActivities := make(map[string]SchemaActivity)
+	for _, activity := range planner.schema.Activities {
+		schemaActivities[activity.Name] = activity
+	}
+
+	for _, change := range planner.changes {
+		var err error
+		if change.Kind == SchemaKindProperty {
+			err = planner.applyProperty(change)
+		} else {
+			err = planner.applyActivity(change, schemaActivities[change.Name])
+		}
+		if err != nil {
+			return applied, fmt.Errorf("%s %s %q: %v", change.Action, change.Kind, change.Name, err)
+		}
+		applied = append(applied, change)
+	}
+
+	// The values of the retyped properties are reset, the computed properties that reference them are recomputed
+	if len(planner.retyped) == 0 {
+		return applied, nil
+	}
+	for _, property := range planner.target {
+		if property.Formula == "" {
+			continue
+		}
+		formula, err := utils.ParseFormula(property.Formula)
+		if err != nil {
+			return applied, err
+		}
+		for _, ref := range formula.References() {
+			if planner.retyped[ref.Name] {
+				if err := recomputePropertysEvents(property.ID); err != nil {
+					return applied, err
+				}
+				break
+			}
+		}
+	}
+	return applied, nil
+}
+
+// PlanSchema returns the changes that make the database match the schema. The
+// records that are not in the schema are deleted only if prune is set.
+func PlanSchema(schema *Schema, prune bool) ([]SchemaChange, error) {
+	planner, err := newSchemaPlanner(schema, prune)
+	if err != nil {
+		return nil, err
+	}
+	return planner.changes, nil
+}
+
+// isSamePlan compares the changes of two plans, the cascades are left out
+// because their counts change with the events.
+func isSamePlan(a, b []SchemaChange) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].Action != b[i].Action || a[i].Kind != b[i].Kind || a[i].Name != b[i].Name {
+			return false
+		}
+		if !reflect.DeepEqual(a[i].Fields, b[i].Fields) {
+			return false
+		}
+	}
+	return true
+}
+
+// ApplySchema applies the planned changes of the schema, it is aborted if the plan of the
+// database differs from them, e.g. the database changed after the plan is confirmed. The
+// applied changes are returned, also with the error of a change that fails midway.
+func ApplySchema(schema *Schema, prune bool, planned []SchemaChange) ([]SchemaChange, error) {
+	planner, err := newSchemaPlanner(schema, prune)
+	if err != nil {
+		return nil, err
+	}
+	if !isSamePlan(planner.changes, planned) {
+		return nil, schemaErrorf("Database changed after the plan, plan the schema again.")
+	}
+	return planner.apply()
+}
+
+// boolQuery parses the boolean query parameter, false if it is not given
+func boolQuery(r *http.Request, name string) (bool, error) {
+	value := r.URL.Query().Get(name)
+	if value == "" {
+		return false, nil
+	}
+	result, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, schemaErrorf("Invalid %s.", name)
+	}
+	return result, nil
+}
+
+// schemaRequest parses the schema of the body and the prune query parameter
+func schemaRequest(r *http.Request) (*Schema, bool, error) {
+	prune, err := boolQuery(r, "prune")
+	if err != nil {
+		return nil, false, err
+	}
+
+	data, err := io.ReadAll(r.Body)
+	if err != nil {
+		return nil, false, err
+	}
+	defer r.Body.Close()
+
+	schema, err := ParseSchema(data)
+	return schema, prune, err
+}
+
+func schemaErrorStatus(err error) int {
+	var schemaErr *SchemaError
+	if errors.As(err, &schemaErr) {
+		return http.StatusBadRequest
+	}
+	return http.StatusInternalServerError
+}
+
+// GetSchemaHandler returns the current schema, as YAML with ?format=yaml
+func GetSchemaHandler(w http.ResponseWriter, r *http.Request) {
+	schema, err := CurrentSchema()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if r.URL.Query().Get("format") == "yaml" {
+		w.Header().Set("Content-Type", "application/yaml")
+		yaml.NewEncoder(w).Encode(schema)
+		return
+	}
+	json.NewEncoder(w).Encode(schema)
+}
+
+// PlanSchemaHandler diffs the YAML or JSON schema of the body with the database
+// e.g. /schema/plan?prune=true
+func PlanSchemaHandler(w http.ResponseWriter, r *http.Request) {
+	schema, prune, err := schemaRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), schemaErrorStatus(err))
+		return
+	}
+
+	changes, err := PlanSchema(schema, prune)
+	if err != nil {
+		http.Error(w, err.Error(), schemaErrorStatus(err))
+		return
+	}
+	json.NewEncoder(w).Encode(changes)
+}
+
+// ApplySchemaHandler applies the YAML or JSON schema of the body to the database, the
+// changes that delete records or change the values of the events require confirm=true.
+// e.g. /schema/apply?prune=true&confirm=true
+func ApplySchemaHandler(w http.ResponseWriter, r *http.Request) {
+	schema, prune, err := schemaRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), schemaErrorStatus(err))
+		return
+	}
+	confirmed, err := boolQuery(r, "confirm")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	changes, err := PlanSchema(schema, prune)
+	if err != nil {
+		http.Error(w, err.Error(), schemaErrorStatus(err))
+		return
+	}
+	if IsDestructive(changes) && !confirmed {
+		http.Error(w, "Changes affect the existing data, see /schema/plan and apply with confirm=true.", http.StatusConflict)
+		return
+	}
+
+	applied, err := ApplySchema(schema, prune, changes)
+	if err != nil {
+		// The changes before the failed one are kept
+		appliedChanges := make([]string, 0, len(applied))
+		for _, change := range applied {
+			appliedChanges = append(appliedChanges, fmt.Sprintf("%s %s %q", change.Action, change.Kind, change.Name))
+		}
+		if len(appliedChanges) != 0 {
+			err = fmt.Errorf("%v, the applied changes are: %s", err, strings.Join(appliedChanges, ", "))
+		}
+		http.Error(w, err.Error(), schemaErrorStatus(err))
+		return
+	}
+	json.NewEncoder(w).Encode(applied)
+}
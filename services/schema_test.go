@@ -0,0 +1,304 @@
+package services
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/djamysh/PensieveAPI/models"
+)
+
+func TestParseSchema(t *testing.T) {
+	want := &Schema{
+		Properties: []SchemaProperty{
+			{Name: "distance", Type: "number"},
+			{Name: "pace", Type: "number", Formula: "distance / duration(timelings)"},
+		},
+		Activities: []SchemaActivity{
+			{Name: "Running", OverlapPolicy: "reject", Properties: []string{"distance", "pace"}},
+		},
+	}
+
+	tests := []struct {
+		name string
+		data string
+	}{
+		{"yaml", `
+properties:
+  - name: distance
+    type: number
+  - name: pace
+    type: number
+    formula: distance / duration(timelings)
+activities:
+  - name: Running
+    overlapPolicy: reject
+    properties: [distance, pace]
+`},
+		{"json with tabs", "{\n\t\"properties\": [\n\t\t{\"name\": \"distance\", \"type\": \"number\"},\n\t\t{\"name\": \"pace\", \"type\": \"number\", \"formula\": \"distance / duration(timelings)\"}\n\t],\n\t\"activities\": [\n\t\t{\"name\": \"Running\", \"overlapPolicy\": \"reject\", \"properties\": [\"distance\", \"pace\"]}\n\t]\n}"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := ParseSchema([]byte(test.data))
+			if err != nil {
+				t.Fatalf("ParseSchema returned the error %v", err)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("ParseSchema = %+v, want %+v", got, want)
+			}
+		})
+	}
+}
+
+func TestParseSchemaErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		wantErr error
+	}{
+		{"empty", "", EmptySchemaErr},
+		{"blank", " \n\t\n", EmptySchemaErr},
+		{"only comments", "# nothing yet\n", EmptySchemaErr},
+		{"unknown yaml field", "properties:\n  - name: a\n    kind: number\n", nil},
+		{"unknown json field", `{"properties": [], "extra": true}`, nil},
+		{"invalid json", `{"properties": [`, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := ParseSchema([]byte(test.data))
+			var schemaErr *SchemaError
+			if !errors.As(err, &schemaErr) {
+				t.Fatalf("ParseSchema returned the error %v, want a *SchemaError", err)
+			}
+			if test.wantErr != nil && err != test.wantErr {
+				t.Errorf("ParseSchema returned the error %v, want %v", err, test.wantErr)
+			}
+		})
+	}
+}
+
+// testPlanner returns a planner of the given database records like newSchemaPlanner without reading them
+func testPlanner(schema *Schema, prune bool, properties []models.Property, activities []models.Activity) *schemaPlanner {
+	planner := &schemaPlanner{
+		schema:     schema,
+		prune:      prune,
+		properties: make(map[string]*models.Property),
+		activities: make(map[string]*models.Activity),
+		changes:    []SchemaChange{},
+		retyped:    make(map[string]bool),
+	}
+	for i := range properties {
+		planner.properties[properties[i].Name] = &properties[i]
+	}
+	for i := range activities {
+		planner.activities[activities[i].Name] = &activities[i]
+	}
+	return planner
+}
+
+var (
+	testNote     = models.Property{ID: primitive.NewObjectID(), Name: "note", ValueDataType: "string", System: true}
+	testTimer    = models.Property{ID: primitive.NewObjectID(), Name: "timelings", ValueDataType: "timelings", System: true}
+	testDistance = models.Property{ID: primitive.NewObjectID(), Name: "distance", Description: "km", ValueDataType: "number"}
+	testMood     = models.Property{ID: primitive.NewObjectID(), Name: "mood", ValueDataType: "number"}
+)
+
+func TestSchemaValidate(t *testing.T) {
+	existing := []models.Property{testNote, testTimer, testDistance, testMood}
+
+	tests := []struct {
+		name    string
+		schema  Schema
+		prune   bool
+		wantErr bool
+	}{
+		{"valid", Schema{
+			Properties: []SchemaProperty{{Name: "pace", Formula: "distance / duration(timelings)"}},
+			Activities: []SchemaActivity{{Name: "Running", Properties: []string{"distance", "pace", "note"}}},
+		}, false, false},
+		{"property without a name", Schema{Properties: []SchemaProperty{{Type: "number"}}}, false, true},
+		{"duplicate property", Schema{Properties: []SchemaProperty{{Name: "a", Type: "number"}, {Name: "a", Type: "string"}}}, false, true},
+		{"invalid type", Schema{Properties: []SchemaProperty{{Name: "a", Type: "percentage"}}}, false, true},
+		{"retyped built-in", Schema{Properties: []SchemaProperty{{Name: "note", Type: "number"}}}, false, true},
+		{"computed built-in", Schema{Properties: []SchemaProperty{{Name: "note", Type: "string", Formula: "mood"}}}, false, true},
+		{"unknown formula reference", Schema{Properties: []SchemaProperty{{Name: "a", Formula: "b * 2"}}}, false, true},
+		{"formula of a pruned property", Schema{Properties: []SchemaProperty{{Name: "a", Formula: "mood * 2"}}}, true, true},
+		{"formula of a kept property", Schema{Properties: []SchemaProperty{{Name: "a", Formula: "mood * 2"}}}, false, false},
+		{"activity without a name", Schema{Activities: []SchemaActivity{{}}}, false, true},
+		{"duplicate activity", Schema{Activities: []SchemaActivity{{Name: "A"}, {Name: "A"}}}, false, true},
+		{"invalid overlap policy", Schema{Activities: []SchemaActivity{{Name: "A", OverlapPolicy: "ignore"}}}, false, true},
+		{"unknown activity property", Schema{Activities: []SchemaActivity{{Name: "A", Properties: []string{"steps"}}}}, false, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			schema := test.schema
+			err := testPlanner(&schema, test.prune, append([]models.Property(nil), existing...), nil).validate()
+			if (err != nil) != test.wantErr {
+				t.Errorf("validate() returned the error %v, want an error: %v", err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestSchemaValidateNormalizes(t *testing.T) {
+	schema := Schema{
+		Properties: []SchemaProperty{{Name: "pace", Type: " Number ", Formula: "distance * 2"}, {Name: "speed", Formula: "distance"}},
+		Activities: []SchemaActivity{{Name: "Running", OverlapPolicy: " WARN", Properties: []string{"note", "distance"}}},
+	}
+	planner := testPlanner(&schema, false, []models.Property{testNote, testDistance}, nil)
+	if err := planner.validate(); err != nil {
+		t.Fatalf("validate() returned the error %v", err)
+	}
+
+	if schema.Properties[0].Type != "number" || schema.Properties[1].Type != "number" {
+		t.Errorf("types are %q and %q, want number", schema.Properties[0].Type, schema.Properties[1].Type)
+	}
+	if schema.Activities[0].OverlapPolicy != models.OverlapWarn {
+		t.Errorf("overlap policy is %q, want %q", schema.Activities[0].OverlapPolicy, models.OverlapWarn)
+	}
+	// The built-in properties are left out
+	if !reflect.DeepEqual(schema.Activities[0].Properties, []string{"distance"}) {
+		t.Errorf("activity properties are %v, want [distance]", schema.Activities[0].Properties)
+	}
+}
+
+func TestSchemaPlan(t *testing.T) {
+	allow := true
+	running := models.Activity{
+		ID:                primitive.NewObjectID(),
+		Name:              "Running",
+		Description:       "Runs",
+		DefinedProperties: []primitive.ObjectID{testDistance.ID},
+	}
+	reading := models.Activity{
+		ID:                    primitive.NewObjectID(),
+		Name:                  "Reading",
+		OverlapPolicy:         models.OverlapAllow,
+		AllowConcurrentTimers: &allow,
+	}
+
+	tests := []struct {
+		name   string
+		schema Schema
+		want   []SchemaChange
+	}{
+		{"no changes", Schema{
+			Properties: []SchemaProperty{{Name: "distance", Description: "km", Type: "number"}},
+			Activities: []SchemaActivity{
+				{Name: "Running", Description: "Runs", Properties: []string{"distance"}},
+				// The not set overlap policy is allow
+				{Name: "Reading", AllowConcurrentTimers: true},
+			},
+		}, []SchemaChange{}},
+		{"created", Schema{
+			Properties: []SchemaProperty{{Name: "steps", Type: "number"}},
+			Activities: []SchemaActivity{{Name: "Walking", Properties: []string{"steps"}}},
+		}, []SchemaChange{
+			{Action: ChangeCreate, Kind: SchemaKindProperty, Name: "steps"},
+			{Action: ChangeCreate, Kind: SchemaKindActivity, Name: "Walking"},
+		}},
+		{"updated fields", Schema{
+			Properties: []SchemaProperty{{Name: "distance", Description: "Kilometers", Type: "number"}},
+			Activities: []SchemaActivity{
+				{Name: "Running", OverlapPolicy: models.OverlapReject, Properties: []string{"distance"}},
+				{Name: "Reading"},
+			},
+		}, []SchemaChange{
+			{Action: ChangeUpdate, Kind: SchemaKindProperty, Name: "distance", Fields: map[string]FieldChange{
+				"description": {"km", "Kilometers"},
+			}},
+			{Action: ChangeUpdate, Kind: SchemaKindActivity, Name: "Running", Fields: map[string]FieldChange{
+				"description":   {"Runs", ""},
+				"overlapPolicy": {"", models.OverlapReject},
+			}},
+			{Action: ChangeUpdate, Kind: SchemaKindActivity, Name: "Reading", Fields: map[string]FieldChange{
+				"allowConcurrentTimers": {true, false},
+			}},
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			schema := test.schema
+			planner := testPlanner(&schema, false, []models.Property{testDistance}, []models.Activity{running, reading})
+			if err := planner.validate(); err != nil {
+				t.Fatalf("validate() returned the error %v", err)
+			}
+			for _, property := range schema.Properties {
+				if err := planner.planProperty(property); err != nil {
+					t.Fatalf("planProperty(%q) returned the error %v", property.Name, err)
+				}
+			}
+			for _, activity := range schema.Activities {
+				if err := planner.planActivity(activity); err != nil {
+					t.Fatalf("planActivity(%q) returned the error %v", activity.Name, err)
+				}
+			}
+			if !reflect.DeepEqual(planner.changes, test.want) {
+				t.Errorf("changes = %+v, want %+v", planner.changes, test.want)
+			}
+		})
+	}
+}
+
+func TestIsDestructive(t *testing.T) {
+	tests := []struct {
+		name    string
+		changes []SchemaChange
+		want    bool
+	}{
+		{"no changes", nil, false},
+		{"create", []SchemaChange{{Action: ChangeCreate, Kind: SchemaKindProperty, Name: "a"}}, false},
+		{"update", []SchemaChange{{Action: ChangeUpdate, Kind: SchemaKindActivity, Name: "A", Fields: map[string]FieldChange{"description": {"", "x"}}}}, false},
+		{"update with cascades", []SchemaChange{{Action: ChangeUpdate, Kind: SchemaKindProperty, Name: "a", Cascades: []string{"Values of 3 events are recomputed"}}}, true},
+		{"delete", []SchemaChange{{Action: ChangeCreate, Name: "a"}, {Action: ChangeDelete, Kind: SchemaKindActivity, Name: "A"}}, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := IsDestructive(test.changes); got != test.want {
+				t.Errorf("IsDestructive() = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestIsSamePlan(t *testing.T) {
+	plan := []SchemaChange{
+		{Action: ChangeCreate, Kind: SchemaKindProperty, Name: "a"},
+		{Action: ChangeUpdate, Kind: SchemaKindActivity, Name: "A", Fields: map[string]FieldChange{"description": {"", "x"}}, Cascades: []string{"3 events"}},
+	}
+	copyPlan := func(modify func(changes []SchemaChange) []SchemaChange) []SchemaChange {
+		changes := make([]SchemaChange, len(plan))
+		copy(changes, plan)
+		return modify(changes)
+	}
+
+	tests := []struct {
+		name  string
+		other []SchemaChange
+		want  bool
+	}{
+		{"same", copyPlan(func(changes []SchemaChange) []SchemaChange { return changes }), true},
+		{"other cascade counts", copyPlan(func(changes []SchemaChange) []SchemaChange {
+			changes[1].Cascades = []string{"4 events"}
+			return changes
+		}), true},
+		{"missing change", plan[:1], false},
+		{"other action", copyPlan(func(changes []SchemaChange) []SchemaChange {
+			changes[0].Action = ChangeDelete
+			return changes
+		}), false},
+		{"other field", copyPlan(func(changes []SchemaChange) []SchemaChange {
+			changes[1].Fields = map[string]FieldChange{"description": {"", "y"}}
+			return changes
+		}), false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := isSamePlan(plan, test.other); got != test.want {
+				t.Errorf("isSamePlan() = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,304 @@
+package services
+
+import (
+	"encoding/json"
+	"html"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/djamysh/PensieveAPI/models"
+)
+
+const defaultSearchLimit = 20
+
+// Number of the characters around the matched term in a snippet
+const snippetRadius = 40
+
+type SearchHit struct {
+	ID       string   `json:"id"`
+	Score    float64  `json:"score"`
+	Snippets []string `json:"snippets"`
+	// Only one of them is given depending on the type of the hit
+	Event    *EventResponse   `json:"event,omitempty"`
+	Activity *models.Activity `json:"activity,omitempty"`
+	Property *models.Property `json:"property,omitempty"`
+}
+
+type SearchResponse struct {
+	Query      string       `json:"query"`
+	Events     []*SearchHit `json:"events"`
+	Activities []*SearchHit `json:"activities"`
+	Properties []*SearchHit `json:"properties"`
+}
+
+// searchTerms returns the stems of the terms of the search to highlight, the negated terms are skipped
+func searchTerms(search string) []string {
+	var terms []string
+	for _, field := range strings.Fields(search) {
+		if strings.HasPrefix(field, "-") {
+			continue
+		}
+		for _, word := range strings.FieldsFunc(field, isNotWordRune) {
+			terms = append(terms, stem(strings.ToLower(word)))
+		}
+	}
+	return terms
+}
+
+// negatedSearchTerms returns the stems of the negated terms of the search, e.g. -walk
+func negatedSearchTerms(search string) []string {
+	var terms []string
+	for _, field := range strings.Fields(search) {
+		if strings.HasPrefix(field, "-") {
+			terms = append(terms, textStems(field)...)
+		}
+	}
+	return terms
+}
+
+func isNotWordRune(r rune) bool {
+	return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+}
+
+// stem reduces the lower cased English word to its stem for the highlighting, e.g. running,
+// runs -> run. The text index matches the stemmed words, so the snippets mark the words
+// with the same stem as a term. It is lighter than the stemmer of the text index.
+func stem(word string) string {
+	runes := []rune(word)
+	hasSuffix := func(suffix string) bool {
+		return len(runes) > len([]rune(suffix))+2 && strings.HasSuffix(string(runes), suffix)
+	}
+	trim := func(n int) { runes = runes[:len(runes)-n] }
+
+	switch {
+	case hasSuffix("ies"), hasSuffix("ied"):
+		trim(3)
+		runes = append(runes, 'y')
+	case hasSuffix("sses"):
+		trim(2)
+	case hasSuffix("ing"), hasSuffix("ed"):
+		if hasSuffix("ing") {
+			trim(3)
+		} else {
+			trim(2)
+		}
+		// running -> runn -> run
+		if n := len(runes); n > 2 && runes[n-1] == runes[n-2] && !strings.ContainsRune("lsz", runes[n-1]) {
+			trim(1)
+		}
+	case hasSuffix("s") && !hasSuffix("ss") && !hasSuffix("us"):
+		trim(1)
+	}
+	return string(runes)
+}
+
+// highlight returns the part of the text around the first matched word with the matched
+// words wrapped in <mark> tags, ok is false if no word matches. A word matches a term if
+// their stems are the same. The text is HTML escaped, only the <mark> tags are markup.
+func highlight(text string, terms []string) (string, bool) {
+	runes := []rune(text)
+	stems := make(map[string]bool)
+	for _, term := range terms {
+		stems[term] = true
+	}
+
+	// Start and end of the matched words
+	var matches [][2]int
+	for i := 0; i < len(runes); {
+		if isNotWordRune(runes[i]) {
+			i++
+			continue
+		}
+		end := i
+		for end < len(runes) && !isNotWordRune(runes[end]) {
+			end++
+		}
+		if stems[stem(strings.ToLower(string(runes[i:end])))] {
+			matches = append(matches, [2]int{i, end})
+		}
+		i = end
+	}
+	if len(matches) == 0 {
+		return "", false
+	}
+
+	first := matches[0][0]
+	start, end := first-snippetRadius, first+snippetRadius
+	if start < 0 {
+		start = 0
+	}
+	if end > len(runes) {
+		end = len(runes)
+	}
+	// The matched words are not cut
+	for _, match := range matches {
+		if match[0] < end && match[1] > end {
+			end = match[1]
+		}
+	}
+
+	var snippet strings.Builder
+	if start > 0 {
+		snippet.WriteString("...")
+	}
+	position := start
+	for _, match := range matches {
+		if match[0] < start || match[0] >= end {
+			continue
+		}
+		snippet.WriteString(html.EscapeString(string(runes[position:match[0]])))
+		snippet.WriteString("<mark>")
+		snippet.WriteString(html.EscapeString(string(runes[match[0]:match[1]])))
+		snippet.WriteString("</mark>")
+		position = match[1]
+	}
+	snippet.WriteString(html.EscapeString(string(runes[position:end])))
+	if end < len(runes) {
+		snippet.WriteString("...")
+	}
+	return snippet.String(), true
+}
+
+// snippets highlights the texts that contain the terms
+func snippets(texts []string, terms []string) []string {
+	result := []string{}
+	for _, text := range texts {
+		if snippet, ok := highlight(text, terms); ok {
+			result = append(result, snippet)
+		}
+	}
+	return result
+}
+
+// SearchHandler searches the string property values of the events and the names and
+// descriptions of the activities and properties with the MongoDB text indexes. The backends
+// that do not support the text search are searched with the inverted index instead.
+// e.g. /search?q=thermodynamics&activityID=...&from=2023-01-01&limit=10
+func SearchHandler(w http.ResponseWriter, r *http.Request) {
+	expander, err := newExpander(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	query := r.URL.Query()
+	search := strings.TrimSpace(query.Get("q"))
+	if search == "" {
+		http.Error(w, "Search query is not given.", http.StatusBadRequest)
+		return
+	}
+
+	limit := int64(defaultSearchLimit)
+	if value := query.Get("limit"); value != "" {
+		var err error
+		if limit, err = strconv.ParseInt(value, 10, 64); err != nil || limit <= 0 {
+			http.Error(w, "Invalid limit.", http.StatusBadRequest)
+			return
+		}
+	}
+
+	eventFilter, err := eventsFilter(r, models.TextSearchFilter(search))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	activitiesFilter := models.TextSearchFilter(search)
+	propertiesFilter := models.TextSearchFilter(search)
+
+	// Optionally scoped to an activity, its properties are the defined properties
+	if hex := query.Get("activityID"); hex != "" {
+		activityID, err := primitive.ObjectIDFromHex(hex)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		activity, err := models.GetActivity(activityID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		eventFilter["activityID"] = activityID
+		activitiesFilter["_id"] = activityID
+		propertiesFilter["_id"] = bson.M{"$in": activity.DefinedProperties}
+	}
+
+	terms := searchTerms(search)
+	response := SearchResponse{
+		Query:      search,
+		Events:     []*SearchHit{},
+		Activities: []*SearchHit{},
+		Properties: []*SearchHit{},
+	}
+
+	eventResults, err := models.SearchEvents(eventFilter, limit)
+	if models.IsTextSearchUnsupportedErr(err) {
+		eventResults, err = searchEventsInMemory(eventFilter, search, limit)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	for i := range eventResults {
+		result := &eventResults[i]
+
+		var texts []string
+		for _, pair := range result.PropertyValues {
+			texts = append(texts, stringValues(pair.Value)...)
+		}
+
+		eventResponse, err := expander.Event(&result.Event)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		response.Events = append(response.Events, &SearchHit{
+			ID:       result.ID.Hex(),
+			Score:    result.Score,
+			Snippets: snippets(texts, terms),
+			Event:    eventResponse,
+		})
+	}
+
+	activityResults, err := models.SearchActivities(activitiesFilter, limit)
+	if models.IsTextSearchUnsupportedErr(err) {
+		activityResults, err = searchActivitiesInMemory(activitiesFilter, search, limit)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	for i := range activityResults {
+		result := &activityResults[i]
+		response.Activities = append(response.Activities, &SearchHit{
+			ID:       result.ID.Hex(),
+			Score:    result.Score,
+			Snippets: snippets([]string{result.Name, result.Description}, terms),
+			Activity: &result.Activity,
+		})
+	}
+
+	propertyResults, err := models.SearchProperties(propertiesFilter, limit)
+	if models.IsTextSearchUnsupportedErr(err) {
+		propertyResults, err = searchPropertiesInMemory(propertiesFilter, search, limit)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	for i := range propertyResults {
+		result := &propertyResults[i]
+		response.Properties = append(response.Properties, &SearchHit{
+			ID:       result.ID.Hex(),
+			Score:    result.Score,
+			Snippets: snippets([]string{result.Name, result.Description}, terms),
+			Property: &result.Property,
+		})
+	}
+
+	json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,83 @@
+package services
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestStem(t *testing.T) {
+	tests := []struct {
+		word string
+		want string
+	}{
+		{"runs", "run"},
+		{"running", "run"},
+		{"walked", "walk"},
+		{"falling", "fall"},
+		{"buzzing", "buzz"},
+		{"studies", "study"},
+		{"studied", "study"},
+		{"classes", "class"},
+		{"class", "class"},
+		{"status", "status"},
+		{"is", "is"},
+		{"thing", "thing"},
+		{"run", "run"},
+	}
+	for _, test := range tests {
+		t.Run(test.word, func(t *testing.T) {
+			if got := stem(test.word); got != test.want {
+				t.Errorf("stem(%q) = %q, want %q", test.word, got, test.want)
+			}
+		})
+	}
+}
+
+func TestSearchTerms(t *testing.T) {
+	tests := []struct {
+		search string
+		want   []string
+	}{
+		{"Running", []string{"run"}},
+		{"long runs -gym", []string{"long", "run"}},
+		{`"long runs" pace`, []string{"long", "run", "pace"}},
+		{"-gym", nil},
+	}
+	for _, test := range tests {
+		t.Run(test.search, func(t *testing.T) {
+			if got := searchTerms(test.search); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("searchTerms(%q) = %v, want %v", test.search, got, test.want)
+			}
+		})
+	}
+}
+
+func TestHighlight(t *testing.T) {
+	long := strings.Repeat("a ", 30) + "ran a run " + strings.Repeat("b ", 30)
+
+	tests := []struct {
+		name   string
+		text   string
+		terms  []string
+		want   string
+		wantOK bool
+	}{
+		{"word", "Morning run", []string{"run"}, "Morning <mark>run</mark>", true},
+		{"same stem", "Runs and running", []string{"run"}, "<mark>Runs</mark> and <mark>running</mark>", true},
+		{"whole words only", "Brunch rerun", []string{"run"}, "", false},
+		{"punctuation", "run, run!", []string{"run"}, "<mark>run</mark>, <mark>run</mark>!", true},
+		{"no match", "Reading", []string{"run"}, "", false},
+		{"escaped", `<script>alert("run")</script>`, []string{"run"}, "&lt;script&gt;alert(&#34;<mark>run</mark>&#34;)&lt;/script&gt;", true},
+		{"escaped tags", "<b>run</b> & walk", []string{"run"}, "&lt;b&gt;<mark>run</mark>&lt;/b&gt; &amp; walk", true},
+		{"around the first match", long, []string{"run"}, "..." + long[66-snippetRadius:66] + "<mark>run</mark>" + long[69:66+snippetRadius] + "...", true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, ok := highlight(test.text, test.terms)
+			if ok != test.wantOK || got != test.want {
+				t.Errorf("highlight(%q) = %q, %v, want %q, %v", test.text, got, ok, test.want, test.wantOK)
+			}
+		})
+	}
+}
@@ -0,0 +1,172 @@
+package services
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+
+	"github.com/djamysh/PensieveAPI/models"
+	"github.com/djamysh/PensieveAPI/utils"
+)
+
+// WorkspaceHeader selects the workspace of the request, whose settings override the global ones
+const WorkspaceHeader = "X-Workspace"
+
+// settingsTTL bounds how long the cached settings are used, the settings may be
+// changed by the commands of another process, e.g. restore or reset.
+const settingsTTL = time.Minute
+
+type cachedSettings struct {
+	settings *models.Settings
+	loadedAt time.Time
+}
+
+// settingsCache holds the settings of the workspaces, keyed by the workspace name
+var settingsCache = struct {
+	sync.RWMutex
+	entries map[string]cachedSettings
+}{entries: make(map[string]cachedSettings)}
+
+// getSettings returns the settings of the workspace from the cache, loading them if they
+// are not cached or expired.
+func getSettings(workspace string) (*models.Settings, error) {
+	settingsCache.RLock()
+	entry, isCached := settingsCache.entries[workspace]
+	settingsCache.RUnlock()
+	if isCached && time.Since(entry.loadedAt) < settingsTTL {
+		return entry.settings, nil
+	}
+
+	settings, err := models.GetSettings(workspace)
+	if err != nil {
+		return nil, err
+	}
+	settingsCache.Lock()
+	settingsCache.entries[workspace] = cachedSettings{settings: settings, loadedAt: time.Now()}
+	settingsCache.Unlock()
+	return settings, nil
+}
+
+// invalidateSettings clears the cached settings, the workspaces inherit the global settings
+// so all of them are cleared.
+func invalidateSettings() {
+	settingsCache.Lock()
+	settingsCache.entries = make(map[string]cachedSettings)
+	settingsCache.Unlock()
+}
+
+// requestWorkspace returns the workspace of the request, empty for the global settings
+func requestWorkspace(r *http.Request) string {
+	return strings.TrimSpace(r.Header.Get(WorkspaceHeader))
+}
+
+func GetSettingsHandler(w http.ResponseWriter, r *http.Request) {
+	settings, err := getSettings(requestWorkspace(r))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(settings)
+}
+
+// UpdateSettingsHandler updates the settings of the workspace of the request, the global
+// settings if no workspace is given.
+func UpdateSettingsHandler(w http.ResponseWriter, r *http.Request) {
+	var settings models.Settings
+	if err := json.NewDecoder(r.Body).Decode(&settings); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+
+	update := make(map[string]interface{})
+	if settings.Timezone != "" {
+		if _, err := time.LoadLocation(settings.Timezone); err != nil {
+			http.Error(w, "Invalid timezone.", http.StatusBadRequest)
+			return
+		}
+		update["timezone"] = settings.Timezone
+	}
+
+	updatedSettings, err := models.UpdateSettings(requestWorkspace(r), bson.M(update))
+	invalidateSettings()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(updatedSettings)
+}
+
+// requestLocation returns the timezone of the request, the tz query parameter
+// overrides the timezone of the request's workspace, which overrides the global one.
+func requestLocation(r *http.Request) (*time.Location, error) {
+	if name := r.URL.Query().Get("tz"); name != "" {
+		return time.LoadLocation(name)
+	}
+	settings, err := getSettings(requestWorkspace(r))
+	if err != nil {
+		return nil, err
+	}
+	return time.LoadLocation(settings.Timezone)
+}
+
+// Location loads the timezone with the given name, the globally configured timezone if the name is empty
+func Location(name string) (*time.Location, error) {
+	if name == "" {
+		settings, err := getSettings("")
+		if err != nil {
+			return nil, err
+		}
+		name = settings.Timezone
+	}
+	return time.LoadLocation(name)
+}
+
+// timeRange parses the from and to query parameters, both are optional and to is exclusive.
+// They can be UNIX timestamps, RFC3339 times or dates in the request's timezone.
+func timeRange(r *http.Request, loc *time.Location) (from, to time.Time, err error) {
+	query := r.URL.Query()
+	if value := query.Get("from"); value != "" {
+		if from, err = utils.ParseTime(value, loc, false); err != nil {
+			return from, to, err
+		}
+	}
+	if value := query.Get("to"); value != "" {
+		if to, err = utils.ParseTime(value, loc, true); err != nil {
+			return from, to, err
+		}
+	}
+	return from, to, nil
+}
+
+// occurredAtFilter adds the occurredAt range condition of the given range to the filter
+func occurredAtFilter(filter bson.M, from, to time.Time) bson.M {
+	condition := bson.M{}
+	if !from.IsZero() {
+		condition["$gte"] = from
+	}
+	if !to.IsZero() {
+		condition["$lt"] = to
+	}
+	if len(condition) != 0 {
+		filter["occurredAt"] = condition
+	}
+	return filter
+}
+
+// eventsFilter builds the filter of the event list endpoints from the range query parameters
+func eventsFilter(r *http.Request, filter bson.M) (bson.M, error) {
+	loc, err := requestLocation(r)
+	if err != nil {
+		return nil, err
+	}
+	from, to, err := timeRange(r, loc)
+	if err != nil {
+		return nil, err
+	}
+	return occurredAtFilter(filter, from, to), nil
+}
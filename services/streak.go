@@ -0,0 +1,186 @@
+package services
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/djamysh/PensieveAPI/models"
+	"github.com/djamysh/PensieveAPI/utils"
+)
+
+// Metrics of the daily values that the streak condition is applied to
+const (
+	MetricCount = "count"
+	MetricSum   = "sum"
+)
+
+type Streak struct {
+	Days  int    `json:"days"`
+	Start string `json:"start,omitempty"`
+	End   string `json:"end,omitempty"`
+}
+
+type StreaksResponse struct {
+	ActivityID     string   `json:"activityID"`
+	Timezone       string   `json:"timezone"`
+	From           string   `json:"from"`
+	To             string   `json:"to"`
+	CurrentStreak  Streak   `json:"currentStreak"`
+	LongestStreak  Streak   `json:"longestStreak"`
+	CompletedDays  int      `json:"completedDays"`
+	TotalDays      int      `json:"totalDays"`
+	CompletionRate float64  `json:"completionRate"`
+	MissedDays     []string `json:"missedDays"`
+}
+
+// dayCondition decides whether a day counts as completed
+type dayCondition struct {
+	Property   *models.Property
+	Metric     string
+	Comparator string
+	Value      float64
+}
+
+// parseDayCondition parses the optional property, metric, op and value query parameters.
+// Without a comparator a day is completed if it has at least one event.
+func parseDayCondition(r *http.Request) (*dayCondition, error) {
+	query := r.URL.Query()
+	condition := dayCondition{Metric: MetricCount}
+	var err error
+
+	if value := query.Get("property"); value != "" {
+		if condition.Property, err = resolveNumberProperty(value); err != nil {
+			return nil, err
+		}
+		condition.Metric = MetricSum
+	}
+	if metric := utils.CleanInput(query.Get("metric")); metric != "" {
+		if metric != MetricCount && metric != MetricSum {
+			return nil, errors.New("Invalid metric")
+		}
+		if metric == MetricSum && condition.Property == nil {
+			return nil, errors.New("Sum metric requires a property")
+		}
+		condition.Metric = metric
+	}
+
+	condition.Comparator = utils.CleanInput(query.Get("op"))
+	if condition.Comparator == "" {
+		return &condition, nil
+	}
+	if !utils.IsValidComparator(condition.Comparator) {
+		return nil, errors.New("Invalid comparator")
+	}
+	if condition.Value, err = strconv.ParseFloat(query.Get("value"), 64); err != nil {
+		return nil, errors.New("Invalid condition value")
+	}
+	return &condition, nil
+}
+
+func (condition *dayCondition) isCompleted(day *dailyValue) bool {
+	if day == nil {
+		day = &dailyValue{}
+	}
+	if condition.Comparator == "" {
+		return day.Count > 0
+	}
+
+	value := float64(day.Count)
+	if condition.Metric == MetricSum {
+		value = day.Sum
+	}
+	return utils.Compare(value, condition.Comparator, condition.Value)
+}
+
+// StreaksHandler computes the habit statistics of an activity per day in the
+// request's timezone, optionally conditioned on the daily count or sum.
+// e.g. /reports/streaks/{activityID}?op=lt&value=5 -> days with less than 5 events
+func StreaksHandler(w http.ResponseWriter, r *http.Request) {
+	params, err := parseReportParams(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	condition, err := parseDayCondition(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	days, err := dailyValues(params, condition.Property)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	today := utils.BucketStart(time.Now(), utils.BucketDay, params.Location)
+
+	// The days range, from the first event day if from is not given, to today
+	first := params.From
+	if first.IsZero() {
+		for day := range days {
+			if first.IsZero() || day.Before(first) {
+				first = day
+			}
+		}
+		if first.IsZero() {
+			first = today
+		}
+	}
+	first = utils.BucketStart(first, utils.BucketDay, params.Location)
+
+	last := today
+	if !params.To.IsZero() {
+		// To is exclusive
+		last = utils.BucketStart(params.To.Add(-time.Second), utils.BucketDay, params.Location)
+	}
+	if err := checkDayRange(first, last); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	response := StreaksResponse{
+		ActivityID: params.ActivityID.Hex(),
+		Timezone:   params.Location.String(),
+		From:       first.Format(utils.DateLayout),
+		To:         last.Format(utils.DateLayout),
+		MissedDays: []string{},
+	}
+
+	var current Streak
+	for day := first; !day.After(last); day = utils.NextBucket(day, utils.BucketDay, params.Location) {
+		date := day.Format(utils.DateLayout)
+
+		if condition.isCompleted(days[day]) {
+			response.CompletedDays++
+			if current.Days == 0 {
+				current.Start = date
+			}
+			current.Days++
+			current.End = date
+			if current.Days > response.LongestStreak.Days {
+				response.LongestStreak = current
+			}
+		} else if day.Equal(today) {
+			// Today is not over yet, it does not break the current streak
+			continue
+		} else {
+			response.MissedDays = append(response.MissedDays, date)
+			current = Streak{}
+		}
+		response.TotalDays++
+	}
+
+	// Missed days reset the streak, therefore the remaining one continues until the last day
+	response.CurrentStreak = current
+
+	if response.TotalDays != 0 {
+		response.CompletionRate = float64(response.CompletedDays) / float64(response.TotalDays)
+	}
+
+	json.NewEncoder(w).Encode(response)
+}
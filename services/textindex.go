@@ -0,0 +1,180 @@
+package services
+
+import (
+	"math"
+	"sort"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+
+	"github.com/djamysh/PensieveAPI/models"
+)
+
+// invertedIndex is the simple text index of the search on the backends that do not have the
+// MongoDB text indexes. It maps the stems of the words to the documents that have them and is
+// built in memory from the documents that match the other conditions of the search.
+type invertedIndex struct {
+	// stem -> document -> number of the words with the stem in the document
+	postings map[string]map[int]int
+	size     int
+}
+
+type indexHit struct {
+	Document int
+	Score    float64
+}
+
+func newInvertedIndex() *invertedIndex {
+	return &invertedIndex{postings: make(map[string]map[int]int)}
+}
+
+// textStems returns the stems of the words of the text, the same stems as the search terms
+func textStems(text string) []string {
+	var stems []string
+	for _, word := range strings.FieldsFunc(text, isNotWordRune) {
+		stems = append(stems, stem(strings.ToLower(word)))
+	}
+	return stems
+}
+
+// add indexes the texts of a document and returns the number of the document
+func (index *invertedIndex) add(texts []string) int {
+	document := index.size
+	index.size++
+	for _, text := range texts {
+		for _, stem := range textStems(text) {
+			if index.postings[stem] == nil {
+				index.postings[stem] = make(map[int]int)
+			}
+			index.postings[stem][document]++
+		}
+	}
+	return document
+}
+
+// contains reports whether the document has a word with the stem of any of the terms
+func (index *invertedIndex) contains(document int, terms []string) bool {
+	for _, term := range terms {
+		if index.postings[term][document] != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// search returns the documents that have any of the terms and none of the negated terms like
+// the text search, ordered by their TF-IDF score. The documents with the same score are in the
+// order they are added.
+func (index *invertedIndex) search(terms, negated []string) []indexHit {
+	excluded := make(map[int]bool)
+	for _, term := range negated {
+		for document := range index.postings[term] {
+			excluded[document] = true
+		}
+	}
+
+	scores := make(map[int]float64)
+	for _, term := range uniqueStrings(terms) {
+		postings := index.postings[term]
+		idf := math.Log(1 + float64(index.size)/float64(len(postings)))
+		for document, frequency := range postings {
+			if !excluded[document] {
+				scores[document] += float64(frequency) * idf
+			}
+		}
+	}
+
+	hits := make([]indexHit, 0, len(scores))
+	for document, score := range scores {
+		hits = append(hits, indexHit{Document: document, Score: score})
+	}
+	sort.Slice(hits, func(i, j int) bool {
+		if hits[i].Score == hits[j].Score {
+			return hits[i].Document < hits[j].Document
+		}
+		return hits[i].Score > hits[j].Score
+	})
+	return hits
+}
+
+// withoutTextSearch returns the copy of the filter without its text search condition
+func withoutTextSearch(filter bson.M) bson.M {
+	result := bson.M{}
+	for key, value := range filter {
+		if key != "$text" {
+			result[key] = value
+		}
+	}
+	return result
+}
+
+// limitHits returns the first limit of the hits
+func limitHits(hits []indexHit, limit int64) []indexHit {
+	if int64(len(hits)) > limit {
+		return hits[:limit]
+	}
+	return hits
+}
+
+// searchEventsInMemory is the equivalent of models.SearchEvents with the inverted index, only
+// the events that have a word of the terms are kept in memory.
+func searchEventsInMemory(filter bson.M, search string, limit int64) ([]models.EventSearchResult, error) {
+	terms, negated := searchTerms(search), negatedSearchTerms(search)
+	index := newInvertedIndex()
+	events := make(map[int]models.Event)
+	err := models.StreamEvents(withoutTextSearch(filter), func(event *models.Event) error {
+		var texts []string
+		for _, pair := range event.PropertyValues {
+			texts = append(texts, stringValues(pair.Value)...)
+		}
+		if document := index.add(texts); index.contains(document, terms) {
+			events[document] = *event
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var results []models.EventSearchResult
+	for _, hit := range limitHits(index.search(terms, negated), limit) {
+		results = append(results, models.EventSearchResult{Event: events[hit.Document], Score: hit.Score})
+	}
+	return results, nil
+}
+
+// searchActivitiesInMemory is the equivalent of models.SearchActivities with the inverted index
+func searchActivitiesInMemory(filter bson.M, search string, limit int64) ([]models.ActivitySearchResult, error) {
+	activities, err := models.GetActivitiesByFilter(withoutTextSearch(filter))
+	if err != nil {
+		return nil, err
+	}
+	index := newInvertedIndex()
+	for i := range activities {
+		index.add([]string{activities[i].Name, activities[i].Description})
+	}
+
+	var results []models.ActivitySearchResult
+	for _, hit := range limitHits(index.search(searchTerms(search), negatedSearchTerms(search)), limit) {
+		results = append(results, models.ActivitySearchResult{Activity: activities[hit.Document], Score: hit.Score})
+	}
+	return results, nil
+}
+
+// searchPropertiesInMemory is the equivalent of models.SearchProperties with the inverted index
+func searchPropertiesInMemory(filter bson.M, search string, limit int64) ([]models.PropertySearchResult, error) {
+	properties, err := models.GetPropertiesByFilter(withoutTextSearch(filter))
+	if err != nil {
+		return nil, err
+	}
+	index := newInvertedIndex()
+	for i := range properties {
+		index.add([]string{properties[i].Name, properties[i].Description})
+	}
+
+	var results []models.PropertySearchResult
+	for _, hit := range limitHits(index.search(searchTerms(search), negatedSearchTerms(search)), limit) {
+		results = append(results, models.PropertySearchResult{Property: properties[hit.Document], Score: hit.Score})
+	}
+	return results, nil
+}
@@ -0,0 +1,36 @@
+package services
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestInvertedIndexSearch(t *testing.T) {
+	index := newInvertedIndex()
+	index.add([]string{"Morning run in the park"})
+	index.add([]string{"Reading", "Thermodynamics chapter"})
+	index.add([]string{"Runs, running and a long run"})
+	index.add([]string{"Walk and run"})
+
+	tests := []struct {
+		name          string
+		search        string
+		wantDocuments []int
+	}{
+		{"most frequent first", "run", []int{2, 0, 3}},
+		{"any of the terms", "thermodynamics park", []int{0, 1}},
+		{"negated term", "run -walk", []int{2, 0}},
+		{"no match", "swim", []int{}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			documents := []int{}
+			for _, hit := range index.search(searchTerms(test.search), negatedSearchTerms(test.search)) {
+				documents = append(documents, hit.Document)
+			}
+			if !reflect.DeepEqual(documents, test.wantDocuments) {
+				t.Errorf("search(%q) = %v, want %v", test.search, documents, test.wantDocuments)
+			}
+		})
+	}
+}
@@ -0,0 +1,296 @@
+package services
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/djamysh/PensieveAPI/models"
+	"github.com/djamysh/PensieveAPI/utils"
+)
+
+// A timer is an event whose default timelings has a start but not an end yet.
+
+type StopTimerRequest struct {
+	// Optional UNIX timestamp, defaults to now
+	End *int64 `json:"end"`
+}
+
+// checkRunningTimer rejects a running timer of an activity that does not allow the concurrent
+// timers if the activity has another one, the stored event of the excludeID is left out. The
+// unique index of the runningTimer makes it atomic, this check gives the conflicting timer.
+func checkRunningTimer(event *models.Event, excludeID primitive.ObjectID) error {
+	if !models.IsRunningTimer(event.PropertyValues) {
+		return nil
+	}
+	activity, err := models.GetActivity(event.ActivityID)
+	if err != nil {
+		return err
+	}
+	if activity.AllowsConcurrentTimers() {
+		return nil
+	}
+
+	filter := models.RunningTimersFilter()
+	filter["activityID"] = event.ActivityID
+	if !excludeID.IsZero() {
+		filter["_id"] = bson.M{"$ne": excludeID}
+	}
+	runningTimers, err := models.GetEventsByFilter(filter)
+	if err != nil {
+		return err
+	}
+	if len(runningTimers) != 0 {
+		return &utils.EventError{Message: fmt.Sprintf("Activity already has a running timer : %s", runningTimers[0].ID.Hex())}
+	}
+	return nil
+}
+
+// eventWriteStatus is the status of an error of writing an event, the running timer
+// that is created by a concurrent request is a conflict.
+func eventWriteStatus(err error) int {
+	if err == models.RunningTimerErr {
+		return http.StatusConflict
+	}
+	return http.StatusInternalServerError
+}
+
+// setRunningTimers sets the running timers of the activity for its allowConcurrentTimers,
+// a conflict is returned if it does not allow them and it has more than one.
+func setRunningTimers(activityID primitive.ObjectID, allowConcurrentTimers bool) error {
+	if err := models.SetRunningTimers(activityID, allowConcurrentTimers); err == models.RunningTimerErr {
+		return &utils.EventError{Message: "Activity has more than one running timer, stop them before disallowing the concurrent timers."}
+	} else if err != nil {
+		return err
+	}
+	return nil
+}
+
+// bootstrapRunningTimers sets the running timers of the events that are created before
+// the runningTimer existed, the activities with more than one of them are logged.
+func bootstrapRunningTimers() error {
+	activities, err := models.GetActivities()
+	if err != nil {
+		return err
+	}
+	for _, activity := range activities {
+		err := models.SetRunningTimers(activity.ID, activity.AllowsConcurrentTimers())
+		if err == models.RunningTimerErr {
+			log.Printf("Activity %q has more than one running timer, the new timers are not restricted until they are stopped.", activity.Name)
+		} else if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func StartTimerHandler(w http.ResponseWriter, r *http.Request) {
+	expander, err := newExpander(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	vars := mux.Vars(r)
+	activityID, err := primitive.ObjectIDFromHex(vars["activityID"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// The body is optional, it may contain the other property values of the event
+	var request CreateEventRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil && err != io.EOF {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+
+	if _, err := models.GetActivity(activityID); err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	now := time.Now().UTC()
+	if request.PropertyValues == nil {
+		request.PropertyValues = make(map[string]interface{})
+	}
+	request.ActivityID = activityID.Hex()
+	request.PropertyValues[models.DefaultTimelingsPropertyID.Hex()] = map[string]int64{TimelingStart: now.Unix()}
+	if request.OccurredAt == nil {
+		request.OccurredAt = &now
+	}
+
+	event, err := ControlEvent(&request, nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	loc, err := requestLocation(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	warnings, err := checkEventRules(event, primitive.NilObjectID, loc)
+	if err != nil {
+		if _, isEventErr := err.(*utils.EventError); isEventErr {
+			http.Error(w, err.Error(), http.StatusConflict)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	event, err = models.CreateEvent(event.ActivityID, event.OccurredAt, event.PropertyValues)
+	if err != nil {
+		http.Error(w, err.Error(), eventWriteStatus(err))
+		return
+	}
+
+	response, err := expander.Event(event)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	response.Warnings = warnings
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(response)
+}
+
+func GetTimersHandler(w http.ResponseWriter, r *http.Request) {
+	expander, err := newExpander(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	filter := models.RunningTimersFilter()
+
+	// Optionally only the timers of the given activity
+	if hex := r.URL.Query().Get("activityID"); hex != "" {
+		activityID, err := primitive.ObjectIDFromHex(hex)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		filter["activityID"] = activityID
+	}
+
+	events, err := models.GetEventsByFilter(filter)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	responses, err := expander.Events(events)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(responses)
+}
+
+func StopTimerHandler(w http.ResponseWriter, r *http.Request) {
+	expander, err := newExpander(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	vars := mux.Vars(r)
+	id, err := primitive.ObjectIDFromHex(vars["id"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var request StopTimerRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil && err != io.EOF {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+
+	event, err := models.GetEvent(id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	timelingsIndex := -1
+	for idx, pair := range event.PropertyValues {
+		if pair.Key == models.DefaultTimelingsPropertyID {
+			timelingsIndex = idx
+			break
+		}
+	}
+	if timelingsIndex == -1 {
+		http.Error(w, "Event is not a timer.", http.StatusBadRequest)
+		return
+	}
+
+	timelings, ok := utils.ToTimelings(event.PropertyValues[timelingsIndex].Value)
+	if !ok {
+		http.Error(w, TimestampErr.Error(), http.StatusInternalServerError)
+		return
+	}
+	if _, isStarted := timelings[TimelingStart]; !isStarted {
+		http.Error(w, "Event is not a timer.", http.StatusBadRequest)
+		return
+	}
+	if _, isStopped := timelings[TimelingEnd]; isStopped {
+		http.Error(w, "Timer is already stopped.", http.StatusConflict)
+		return
+	}
+
+	end := time.Now().Unix()
+	if request.End != nil {
+		end = *request.End
+	}
+	timelings[TimelingEnd] = end
+	if timelings[TimelingEnd] < timelings[TimelingStart] {
+		http.Error(w, IntervalErr.Error(), http.StatusBadRequest)
+		return
+	}
+	event.PropertyValues[timelingsIndex].Value = timelings
+
+	// The stopped timer is an update of the event, its running value is excluded
+	loc, err := requestLocation(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	warnings, err := checkEventRules(event, event.ID, loc)
+	if err != nil {
+		if _, isEventErr := err.(*utils.EventError); isEventErr {
+			http.Error(w, err.Error(), http.StatusConflict)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	// The activityID is given so the running timer of the event is removed
+	if _, err := models.UpdateEvent(event.ID, bson.M{"activityID": event.ActivityID, "propertyValues": event.PropertyValues}); err != nil {
+		http.Error(w, err.Error(), eventWriteStatus(err))
+		return
+	}
+
+	// Send the stopped timer as a response
+	response, err := expander.Event(event)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	response.Warnings = warnings
+	json.NewEncoder(w).Encode(response)
+}
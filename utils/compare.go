@@ -0,0 +1,38 @@
+package utils
+
+// Comparators of the conditions, e.g. days with < 5 cigarettes -> lt 5
+const (
+	ComparatorLT  = "lt"
+	ComparatorLTE = "lte"
+	ComparatorGT  = "gt"
+	ComparatorGTE = "gte"
+	ComparatorEQ  = "eq"
+	ComparatorNE  = "ne"
+)
+
+func IsValidComparator(comparator string) bool {
+	switch comparator {
+	case ComparatorLT, ComparatorLTE, ComparatorGT, ComparatorGTE, ComparatorEQ, ComparatorNE:
+		return true
+	}
+	return false
+}
+
+// Compare reports whether value <comparator> target holds
+func Compare(value float64, comparator string, target float64) bool {
+	switch comparator {
+	case ComparatorLT:
+		return value < target
+	case ComparatorLTE:
+		return value <= target
+	case ComparatorGT:
+		return value > target
+	case ComparatorGTE:
+		return value >= target
+	case ComparatorEQ:
+		return value == target
+	case ComparatorNE:
+		return value != target
+	}
+	return false
+}
@@ -0,0 +1,102 @@
+package utils
+
+import (
+	"math"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// ToFloat64 converts the numeric values that come from the JSON decoder
+// or from the BSON decoder into float64.
+func ToFloat64(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case float64:
+		return v, true
+	case float32:
+		return float64(v), true
+	case int:
+		return float64(v), true
+	case int32:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	}
+	return 0, false
+}
+
+// ToInt64 converts the integral numeric values into int64
+func ToInt64(value interface{}) (int64, bool) {
+	f, ok := ToFloat64(value)
+	if !ok || f != math.Trunc(f) {
+		return 0, false
+	}
+	return int64(f), true
+}
+
+// ToTimelings converts the possible representations of a timelings value
+// (JSON decoded map, BSON decoded document) into map[string]int64.
+func ToTimelings(value interface{}) (map[string]int64, bool) {
+	timelings := make(map[string]int64)
+
+	switch v := value.(type) {
+	case map[string]int64:
+		return v, true
+	case map[string]interface{}:
+		for key, element := range v {
+			timestamp, ok := ToInt64(element)
+			if !ok {
+				return nil, false
+			}
+			timelings[key] = timestamp
+		}
+	case primitive.M:
+		return ToTimelings(map[string]interface{}(v))
+	case primitive.D:
+		return ToTimelings(map[string]interface{}(v.Map()))
+	default:
+		return nil, false
+	}
+	return timelings, true
+}
+
+// ToStrings converts the possible representations of a string array value into []string
+func ToStrings(value interface{}) ([]string, bool) {
+	switch v := value.(type) {
+	case []string:
+		return v, true
+	case []interface{}:
+		strs := make([]string, 0, len(v))
+		for _, element := range v {
+			str, ok := element.(string)
+			if !ok {
+				return nil, false
+			}
+			strs = append(strs, str)
+		}
+		return strs, true
+	case primitive.A:
+		return ToStrings([]interface{}(v))
+	}
+	return nil, false
+}
+
+// ToFloat64s converts the possible representations of a number array value into []float64
+func ToFloat64s(value interface{}) ([]float64, bool) {
+	switch v := value.(type) {
+	case []float64:
+		return v, true
+	case []interface{}:
+		numbers := make([]float64, 0, len(v))
+		for _, element := range v {
+			number, ok := ToFloat64(element)
+			if !ok {
+				return nil, false
+			}
+			numbers = append(numbers, number)
+		}
+		return numbers, true
+	case primitive.A:
+		return ToFloat64s([]interface{}(v))
+	}
+	return nil, false
+}
@@ -0,0 +1,83 @@
+package utils
+
+import (
+	"reflect"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestToTimelings(t *testing.T) {
+	tests := []struct {
+		name   string
+		value  interface{}
+		want   map[string]int64
+		wantOK bool
+	}{
+		{"int64 map", map[string]int64{"start": 1, "end": 2}, map[string]int64{"start": 1, "end": 2}, true},
+		{"JSON decoded", map[string]interface{}{"instant": float64(1690000000)}, map[string]int64{"instant": 1690000000}, true},
+		{"BSON document", primitive.M{"start": int32(5), "end": int64(7)}, map[string]int64{"start": 5, "end": 7}, true},
+		{"BSON ordered document", primitive.D{{Key: "instant", Value: int64(9)}}, map[string]int64{"instant": 9}, true},
+		{"empty", map[string]interface{}{}, map[string]int64{}, true},
+		{"fractional timestamp", map[string]interface{}{"instant": 1.5}, nil, false},
+		{"string timestamp", map[string]interface{}{"instant": "1690000000"}, nil, false},
+		{"not a map", "instant", nil, false},
+		{"nil", nil, nil, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, ok := ToTimelings(test.value)
+			if ok != test.wantOK || (ok && !reflect.DeepEqual(got, test.want)) {
+				t.Errorf("ToTimelings(%v) = %v, %v, want %v, %v", test.value, got, ok, test.want, test.wantOK)
+			}
+		})
+	}
+}
+
+func TestToStrings(t *testing.T) {
+	tests := []struct {
+		name   string
+		value  interface{}
+		want   []string
+		wantOK bool
+	}{
+		{"strings", []string{"a", "b"}, []string{"a", "b"}, true},
+		{"JSON decoded", []interface{}{"a", "b"}, []string{"a", "b"}, true},
+		{"BSON array", primitive.A{"a"}, []string{"a"}, true},
+		{"empty", []interface{}{}, []string{}, true},
+		{"mixed", []interface{}{"a", 1.0}, nil, false},
+		{"string", "a", nil, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, ok := ToStrings(test.value)
+			if ok != test.wantOK || (ok && !reflect.DeepEqual(got, test.want)) {
+				t.Errorf("ToStrings(%v) = %v, %v, want %v, %v", test.value, got, ok, test.want, test.wantOK)
+			}
+		})
+	}
+}
+
+func TestToFloat64s(t *testing.T) {
+	tests := []struct {
+		name   string
+		value  interface{}
+		want   []float64
+		wantOK bool
+	}{
+		{"floats", []float64{1.5, 2}, []float64{1.5, 2}, true},
+		{"JSON decoded", []interface{}{1.5, 2.0}, []float64{1.5, 2}, true},
+		{"BSON array", primitive.A{int32(1), int64(2), 3.5}, []float64{1, 2, 3.5}, true},
+		{"empty", primitive.A{}, []float64{}, true},
+		{"mixed", []interface{}{1.0, "2"}, nil, false},
+		{"number", 1.0, nil, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, ok := ToFloat64s(test.value)
+			if ok != test.wantOK || (ok && !reflect.DeepEqual(got, test.want)) {
+				t.Errorf("ToFloat64s(%v) = %v, %v, want %v, %v", test.value, got, ok, test.want, test.wantOK)
+			}
+		})
+	}
+}
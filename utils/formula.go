@@ -0,0 +1,345 @@
+package utils
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Formulas of the computed properties, e.g. "distance / duration(timelings)"
+//
+// expr   := term (('+' | '-') term)*
+// term   := factor (('*' | '/') factor)*
+// factor := number | ref | 'duration' '(' ref ')' | '(' expr ')' | '-' factor
+// ref    := identifier | '[' property name ']'
+//
+// Names that are not identifiers, e.g. names with spaces, are written in brackets.
+
+// FormulaRef is a reference to another property of the event
+type FormulaRef struct {
+	Name string
+	// Duration references the duration in seconds of a timelings property
+	Duration bool
+}
+
+// FormulaResolver returns the value of the referenced property, ok is false if it has no value
+type FormulaResolver func(ref FormulaRef) (float64, bool)
+
+type formulaNode interface {
+	eval(resolve FormulaResolver) (float64, bool)
+}
+
+type numberNode float64
+
+type refNode FormulaRef
+
+type negateNode struct {
+	operand formulaNode
+}
+
+type binaryNode struct {
+	op          byte
+	left, right formulaNode
+}
+
+func (node numberNode) eval(resolve FormulaResolver) (float64, bool) {
+	return float64(node), true
+}
+
+func (node refNode) eval(resolve FormulaResolver) (float64, bool) {
+	return resolve(FormulaRef(node))
+}
+
+func (node negateNode) eval(resolve FormulaResolver) (float64, bool) {
+	value, ok := node.operand.eval(resolve)
+	return -value, ok
+}
+
+func (node binaryNode) eval(resolve FormulaResolver) (float64, bool) {
+	left, ok := node.left.eval(resolve)
+	if !ok {
+		return 0, false
+	}
+	right, ok := node.right.eval(resolve)
+	if !ok {
+		return 0, false
+	}
+
+	switch node.op {
+	case '+':
+		return left + right, true
+	case '-':
+		return left - right, true
+	case '*':
+		return left * right, true
+	default:
+		// Division by zero has no value
+		if right == 0 {
+			return 0, false
+		}
+		return left / right, true
+	}
+}
+
+type Formula struct {
+	root       formulaNode
+	references []FormulaRef
+}
+
+// Eval evaluates the formula, ok is false if a referenced value is missing or on division by zero
+func (formula *Formula) Eval(resolve FormulaResolver) (float64, bool) {
+	return formula.root.eval(resolve)
+}
+
+// References returns the properties that the formula references
+func (formula *Formula) References() []FormulaRef {
+	return formula.references
+}
+
+// RenameReference returns the formula with the references of the property renamed
+func (formula *Formula) RenameReference(from, to string) *Formula {
+	renamed := &Formula{root: renameNode(formula.root, from, to)}
+	for _, ref := range formula.references {
+		if ref.Name == from {
+			ref.Name = to
+		}
+		renamed.references = append(renamed.references, ref)
+	}
+	return renamed
+}
+
+func renameNode(node formulaNode, from, to string) formulaNode {
+	switch node := node.(type) {
+	case refNode:
+		if node.Name == from {
+			node.Name = to
+		}
+		return node
+	case negateNode:
+		return negateNode{operand: renameNode(node.operand, from, to)}
+	case binaryNode:
+		return binaryNode{op: node.op, left: renameNode(node.left, from, to), right: renameNode(node.right, from, to)}
+	}
+	return node
+}
+
+// String returns the formula in the syntax of ParseFormula, the names that are
+// not identifiers are bracketed and only the required parentheses are written.
+func (formula *Formula) String() string {
+	return formatNode(formula.root)
+}
+
+func precedence(node formulaNode) int {
+	if node, isBinary := node.(binaryNode); isBinary {
+		if node.op == '+' || node.op == '-' {
+			return 1
+		}
+		return 2
+	}
+	return 3
+}
+
+func formatName(name string) string {
+	for i := 0; i < len(name); i++ {
+		if !isIdentStart(name[i]) && (i == 0 || name[i] < '0' || name[i] > '9') {
+			return "[" + name + "]"
+		}
+	}
+	return name
+}
+
+func formatNode(node formulaNode) string {
+	switch node := node.(type) {
+	case numberNode:
+		return strconv.FormatFloat(float64(node), 'f', -1, 64)
+	case refNode:
+		if node.Duration {
+			return "duration(" + formatName(node.Name) + ")"
+		}
+		return formatName(node.Name)
+	case negateNode:
+		if precedence(node.operand) < 3 {
+			return "-(" + formatNode(node.operand) + ")"
+		}
+		return "-" + formatNode(node.operand)
+	case binaryNode:
+		left, right := formatNode(node.left), formatNode(node.right)
+		// The operators are left associative, the right operand of the same precedence is grouped
+		if precedence(node.left) < precedence(node) {
+			left = "(" + left + ")"
+		}
+		if precedence(node.right) <= precedence(node) {
+			right = "(" + right + ")"
+		}
+		return left + " " + string(node.op) + " " + right
+	}
+	return ""
+}
+
+type formulaParser struct {
+	src        string
+	pos        int
+	references []FormulaRef
+}
+
+func ParseFormula(src string) (*Formula, error) {
+	parser := &formulaParser{src: src}
+	root, err := parser.parseExpr()
+	if err != nil {
+		return nil, err
+	}
+	if parser.skipSpaces(); parser.pos != len(parser.src) {
+		return nil, parser.errorf("unexpected %q", parser.src[parser.pos])
+	}
+	return &Formula{root: root, references: parser.references}, nil
+}
+
+func (parser *formulaParser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("Invalid formula at %d: %s", parser.pos, fmt.Sprintf(format, args...))
+}
+
+func (parser *formulaParser) skipSpaces() {
+	for parser.pos < len(parser.src) && unicode.IsSpace(rune(parser.src[parser.pos])) {
+		parser.pos++
+	}
+}
+
+// peek returns the next non space character, 0 at the end of the formula
+func (parser *formulaParser) peek() byte {
+	parser.skipSpaces()
+	if parser.pos == len(parser.src) {
+		return 0
+	}
+	return parser.src[parser.pos]
+}
+
+func (parser *formulaParser) expect(c byte) error {
+	if parser.peek() != c {
+		return parser.errorf("expected %q", c)
+	}
+	parser.pos++
+	return nil
+}
+
+func (parser *formulaParser) parseExpr() (formulaNode, error) {
+	left, err := parser.parseTerm()
+	if err != nil {
+		return nil, err
+	}
+	for op := parser.peek(); op == '+' || op == '-'; op = parser.peek() {
+		parser.pos++
+		right, err := parser.parseTerm()
+		if err != nil {
+			return nil, err
+		}
+		left = binaryNode{op: op, left: left, right: right}
+	}
+	return left, nil
+}
+
+func (parser *formulaParser) parseTerm() (formulaNode, error) {
+	left, err := parser.parseFactor()
+	if err != nil {
+		return nil, err
+	}
+	for op := parser.peek(); op == '*' || op == '/'; op = parser.peek() {
+		parser.pos++
+		right, err := parser.parseFactor()
+		if err != nil {
+			return nil, err
+		}
+		left = binaryNode{op: op, left: left, right: right}
+	}
+	return left, nil
+}
+
+func (parser *formulaParser) parseFactor() (formulaNode, error) {
+	c := parser.peek()
+	switch {
+	case c == '-':
+		parser.pos++
+		operand, err := parser.parseFactor()
+		if err != nil {
+			return nil, err
+		}
+		return negateNode{operand: operand}, nil
+	case c == '(':
+		parser.pos++
+		node, err := parser.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+		return node, parser.expect(')')
+	case c == '.' || (c >= '0' && c <= '9'):
+		return parser.parseNumber()
+	case c == '[' || isIdentStart(c):
+		name, isBracketed, err := parser.parseName()
+		if err != nil {
+			return nil, err
+		}
+		// duration(ref) function call
+		if !isBracketed && name == "duration" && parser.peek() == '(' {
+			parser.pos++
+			parser.skipSpaces()
+			if name, _, err = parser.parseName(); err != nil {
+				return nil, err
+			}
+			if err := parser.expect(')'); err != nil {
+				return nil, err
+			}
+			return parser.reference(name, true), nil
+		}
+		return parser.reference(name, false), nil
+	case c == 0:
+		return nil, parser.errorf("unexpected end of formula")
+	}
+	return nil, parser.errorf("unexpected %q", c)
+}
+
+func (parser *formulaParser) reference(name string, isDuration bool) formulaNode {
+	ref := FormulaRef{Name: name, Duration: isDuration}
+	parser.references = append(parser.references, ref)
+	return refNode(ref)
+}
+
+func (parser *formulaParser) parseNumber() (formulaNode, error) {
+	start := parser.pos
+	for parser.pos < len(parser.src) && (parser.src[parser.pos] == '.' || (parser.src[parser.pos] >= '0' && parser.src[parser.pos] <= '9')) {
+		parser.pos++
+	}
+	value, err := strconv.ParseFloat(parser.src[start:parser.pos], 64)
+	if err != nil {
+		return nil, parser.errorf("invalid number %q", parser.src[start:parser.pos])
+	}
+	return numberNode(value), nil
+}
+
+// parseName parses an identifier or a bracketed property name
+func (parser *formulaParser) parseName() (name string, isBracketed bool, err error) {
+	if parser.peek() == '[' {
+		end := strings.IndexByte(parser.src[parser.pos:], ']')
+		if end == -1 {
+			return "", true, parser.errorf("expected ']'")
+		}
+		name = strings.TrimSpace(parser.src[parser.pos+1 : parser.pos+end])
+		parser.pos += end + 1
+		if name == "" {
+			return "", true, parser.errorf("empty property name")
+		}
+		return name, true, nil
+	}
+
+	start := parser.pos
+	if parser.pos == len(parser.src) || !isIdentStart(parser.src[parser.pos]) {
+		return "", false, parser.errorf("expected property name")
+	}
+	for parser.pos < len(parser.src) && (isIdentStart(parser.src[parser.pos]) || (parser.src[parser.pos] >= '0' && parser.src[parser.pos] <= '9')) {
+		parser.pos++
+	}
+	return parser.src[start:parser.pos], false, nil
+}
+
+func isIdentStart(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
@@ -0,0 +1,153 @@
+package utils
+
+import (
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestParseFormula(t *testing.T) {
+	values := map[string]float64{"distance": 10, "pages": 4, "reading time": 3600}
+	durations := map[string]float64{"timelings": 1800}
+	resolve := func(ref FormulaRef) (float64, bool) {
+		if ref.Duration {
+			value, ok := durations[ref.Name]
+			return value, ok
+		}
+		value, ok := values[ref.Name]
+		return value, ok
+	}
+
+	tests := []struct {
+		name       string
+		src        string
+		want       float64
+		wantOK     bool
+		references []FormulaRef
+	}{
+		{"number", "42", 42, true, nil},
+		{"decimal", ".5 + 1.25", 1.75, true, nil},
+		{"precedence", "1 + 2 * 3", 7, true, nil},
+		{"parentheses", "(1 + 2) * 3", 9, true, nil},
+		{"left associative", "8 - 4 - 2", 2, true, nil},
+		{"negation", "-distance + 1", -9, true, []FormulaRef{{Name: "distance"}}},
+		{"double negation", "--2", 2, true, nil},
+		{"reference", "distance / pages", 2.5, true, []FormulaRef{{Name: "distance"}, {Name: "pages"}}},
+		{"bracketed name", "[reading time] / 60", 60, true, []FormulaRef{{Name: "reading time"}}},
+		{"duration", "distance / duration(timelings)", 10.0 / 1800, true, []FormulaRef{{Name: "distance"}, {Name: "timelings", Duration: true}}},
+		{"missing value", "missing * 2", 0, false, []FormulaRef{{Name: "missing"}}},
+		{"division by zero", "distance / (pages - 4)", 0, false, []FormulaRef{{Name: "distance"}, {Name: "pages"}}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			formula, err := ParseFormula(test.src)
+			if err != nil {
+				t.Fatalf("ParseFormula(%q) returned the error %v", test.src, err)
+			}
+			got, ok := formula.Eval(resolve)
+			if ok != test.wantOK || (ok && math.Abs(got-test.want) > 1e-9) {
+				t.Errorf("Eval() = %v, %v, want %v, %v", got, ok, test.want, test.wantOK)
+			}
+			if !reflect.DeepEqual(formula.References(), test.references) {
+				t.Errorf("References() = %v, want %v", formula.References(), test.references)
+			}
+		})
+	}
+}
+
+func TestParseFormulaErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+	}{
+		{"empty", ""},
+		{"only spaces", "   "},
+		{"dangling operator", "1 +"},
+		{"unclosed parenthesis", "(1 + 2"},
+		{"unclosed bracket", "[reading time / 2"},
+		{"empty bracket", "[ ] + 1"},
+		{"trailing input", "1 2"},
+		{"invalid number", "1..2"},
+		{"unclosed duration", "duration(timelings"},
+		{"unknown character", "distance % 2"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := ParseFormula(test.src); err == nil {
+				t.Errorf("ParseFormula(%q) returned no error", test.src)
+			}
+		})
+	}
+}
+
+func TestFormulaString(t *testing.T) {
+	tests := []struct {
+		src  string
+		want string
+	}{
+		{"1+2*3", "1 + 2 * 3"},
+		{"(1+2)*3", "(1 + 2) * 3"},
+		{"8-(4-2)", "8 - (4 - 2)"},
+		{"(8-4)-2", "8 - 4 - 2"},
+		{"a/(b*c)", "a / (b * c)"},
+		{"-(a+b)", "-(a + b)"},
+		{"-a*b", "-a * b"},
+		{"[reading time]/duration( [my timer] )", "[reading time] / duration([my timer])"},
+		{"0.5*x_1", "0.5 * x_1"},
+	}
+	for _, test := range tests {
+		t.Run(test.src, func(t *testing.T) {
+			formula, err := ParseFormula(test.src)
+			if err != nil {
+				t.Fatalf("ParseFormula(%q) returned the error %v", test.src, err)
+			}
+			got := formula.String()
+			if got != test.want {
+				t.Errorf("String() = %q, want %q", got, test.want)
+			}
+			// The formatted formula parses into the same formula
+			reparsed, err := ParseFormula(got)
+			if err != nil {
+				t.Fatalf("ParseFormula(%q) returned the error %v", got, err)
+			}
+			if reparsed.String() != got {
+				t.Errorf("String() of the reparsed formula = %q, want %q", reparsed.String(), got)
+			}
+		})
+	}
+}
+
+func TestFormulaRenameReference(t *testing.T) {
+	tests := []struct {
+		name     string
+		src      string
+		from, to string
+		want     string
+	}{
+		{"identifier", "note * 2", "note", "note (user)", "[note (user)] * 2"},
+		{"duration", "distance / duration(timelings)", "timelings", "timelings (user)", "distance / duration([timelings (user)])"},
+		{"every reference", "note + note / pages", "note", "memo", "memo + memo / pages"},
+		{"not referenced", "distance / pages", "note", "memo", "distance / pages"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			formula, err := ParseFormula(test.src)
+			if err != nil {
+				t.Fatalf("ParseFormula(%q) returned the error %v", test.src, err)
+			}
+			renamed := formula.RenameReference(test.from, test.to)
+			if got := renamed.String(); got != test.want {
+				t.Errorf("String() = %q, want %q", got, test.want)
+			}
+			for _, ref := range renamed.References() {
+				if ref.Name == test.from {
+					t.Errorf("References() still has %q", test.from)
+				}
+			}
+			// The original formula is not changed
+			if reparsed, _ := ParseFormula(test.src); formula.String() != reparsed.String() {
+				t.Errorf("original formula is changed to %q", formula.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,88 @@
+package utils
+
+import (
+	"strconv"
+	"time"
+)
+
+// Time buckets that are used by the date bucketing of the reports
+const (
+	BucketHour  = "hour"
+	BucketDay   = "day"
+	BucketWeek  = "week"
+	BucketMonth = "month"
+	BucketYear  = "year"
+)
+
+const DateLayout = "2006-01-02"
+
+func IsValidBucket(bucket string) bool {
+	switch bucket {
+	case BucketHour, BucketDay, BucketWeek, BucketMonth, BucketYear:
+		return true
+	}
+	return false
+}
+
+// BucketStart returns the start of the bucket that contains t in the given location.
+// Weeks start on Monday. Day boundaries are computed with time.Date, therefore the
+// days that are 23 or 25 hours long because of DST are handled correctly.
+func BucketStart(t time.Time, bucket string, loc *time.Location) time.Time {
+	t = t.In(loc)
+	year, month, day := t.Date()
+
+	switch bucket {
+	case BucketHour:
+		return t.Add(-time.Duration(t.Minute())*time.Minute - time.Duration(t.Second())*time.Second - time.Duration(t.Nanosecond()))
+	case BucketWeek:
+		// Monday -> 0, Sunday -> 6
+		offset := (int(t.Weekday()) + 6) % 7
+		return time.Date(year, month, day-offset, 0, 0, 0, 0, loc)
+	case BucketMonth:
+		return time.Date(year, month, 1, 0, 0, 0, 0, loc)
+	case BucketYear:
+		return time.Date(year, time.January, 1, 0, 0, 0, 0, loc)
+	default:
+		return time.Date(year, month, day, 0, 0, 0, 0, loc)
+	}
+}
+
+// NextBucket returns the start of the bucket that follows the bucket starting at start
+func NextBucket(start time.Time, bucket string, loc *time.Location) time.Time {
+	start = start.In(loc)
+	year, month, day := start.Date()
+
+	switch bucket {
+	case BucketHour:
+		return start.Add(time.Hour)
+	case BucketWeek:
+		return time.Date(year, month, day+7, 0, 0, 0, 0, loc)
+	case BucketMonth:
+		return time.Date(year, month+1, 1, 0, 0, 0, 0, loc)
+	case BucketYear:
+		return time.Date(year+1, time.January, 1, 0, 0, 0, 0, loc)
+	default:
+		return time.Date(year, month, day+1, 0, 0, 0, 0, loc)
+	}
+}
+
+// ParseTime parses a UNIX timestamp, a RFC3339 time or a date in the given location.
+// If nextDay is true, a date is resolved to the start of the following day, so that
+// it can be used as an exclusive upper bound that covers the whole given day.
+func ParseTime(value string, loc *time.Location, nextDay bool) (time.Time, error) {
+	if timestamp, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.Unix(timestamp, 0).UTC(), nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t.UTC(), nil
+	}
+
+	t, err := time.ParseInLocation(DateLayout, value, loc)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if nextDay {
+		t = NextBucket(t, BucketDay, loc)
+	}
+	return t.UTC(), nil
+}